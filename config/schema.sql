@@ -6,7 +6,9 @@ CREATE TABLE `memos` (
   `is_private` tinyint(4) NOT NULL DEFAULT '0',
   `created_at` datetime NOT NULL,
   `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-  PRIMARY KEY (`id`)
+  `deleted_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `memos_deleted_at_idx` (`deleted_at`)
 ) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
 
 DROP TABLE IF EXISTS `users`;
@@ -19,3 +21,25 @@ CREATE TABLE `users` (
   PRIMARY KEY (`id`),
   UNIQUE KEY `users_username_idx` (`username`)
 ) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `api_tokens`;
+CREATE TABLE `api_tokens` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user` int(11) NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `scope` varchar(16) NOT NULL DEFAULT 'read',
+  `created_at` datetime NOT NULL,
+  `last_used_at` datetime,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `api_tokens_token_hash_idx` (`token_hash`),
+  KEY `api_tokens_user_idx` (`user`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `memo_tags`;
+CREATE TABLE `memo_tags` (
+  `memo_id` int(11) NOT NULL,
+  `tag` varchar(64) NOT NULL,
+  PRIMARY KEY (`memo_id`, `tag`),
+  KEY `memo_tags_tag_idx` (`tag`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every request goes through withAccessLog, which gives it a request ID
+// (X-Request-Id, kept from the client when it looks sane) and writes one
+// access log line when it finishes. Handlers reach the line being built
+// through their ResponseWriter, so serverError can tag its log line and
+// response with the ID and getUser can record who made the request
+// without any signature changing.
+
+// AccessLogConfig is the access_log section of the config file.
+type AccessLogConfig struct {
+	// Format is "ltsv" (the default), "json" or "off".
+	Format string `json:"format"`
+	// Path is the file to append to; empty means stderr.
+	Path string `json:"path"`
+}
+
+const requestIDHeader = "X-Request-Id"
+
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ltsvEscaper keeps client-supplied values such as the URI and user agent
+// from breaking a line into extra fields.
+var ltsvEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+type accessLogger struct {
+	mu     sync.Mutex
+	format string
+	w      io.Writer
+}
+
+func newAccessLogger(c AccessLogConfig) (*accessLogger, error) {
+	l := &accessLogger{format: c.Format, w: os.Stderr}
+	switch l.format {
+	case "":
+		l.format = "ltsv"
+	case "ltsv", "json", "off":
+	default:
+		return nil, fmt.Errorf("access_log: unknown format %q", c.Format)
+	}
+	if c.Path != "" && l.format != "off" {
+		f, err := os.OpenFile(c.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("access_log: %s", err)
+		}
+		l.w = f
+	}
+	return l, nil
+}
+
+// accessRecord is one access log line. Field order is the LTSV order.
+type accessRecord struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"reqid"`
+	Host       string  `json:"host"`
+	Method     string  `json:"method"`
+	URI        string  `json:"uri"`
+	Status     int     `json:"status"`
+	Size       int     `json:"size"`
+	ReqTime    float64 `json:"reqtime"`
+	User       int     `json:"user"`
+	SessionNew bool    `json:"session_new"`
+	UserAgent  string  `json:"ua"`
+	// Route is the mux route template, for metrics.
+	Route string `json:"-"`
+}
+
+func (rec *accessRecord) ltsv() string {
+	fields := []string{
+		"time:" + rec.Time,
+		"reqid:" + rec.RequestID,
+		"host:" + rec.Host,
+		"method:" + rec.Method,
+		"uri:" + rec.URI,
+		"status:" + strconv.Itoa(rec.Status),
+		"size:" + strconv.Itoa(rec.Size),
+		"reqtime:" + strconv.FormatFloat(rec.ReqTime, 'f', 6, 64),
+		"user:" + strconv.Itoa(rec.User),
+		"session_new:" + strconv.FormatBool(rec.SessionNew),
+		"ua:" + rec.UserAgent,
+	}
+	for i, f := range fields {
+		fields[i] = ltsvEscaper.Replace(f)
+	}
+	return strings.Join(fields, "\t") + "\n"
+}
+
+func (l *accessLogger) write(rec *accessRecord) {
+	var line []byte
+	switch l.format {
+	case "off":
+		return
+	case "json":
+		b, err := json.Marshal(rec)
+		if err != nil {
+			log.Printf("error: access log: %s", err)
+			return
+		}
+		line = append(b, '\n')
+	default:
+		line = []byte(rec.ltsv())
+	}
+	l.mu.Lock()
+	l.w.Write(line)
+	l.mu.Unlock()
+}
+
+// loggingResponseWriter records what the access log needs while passing
+// everything through.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	rec *accessRecord
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	if w.rec.Status == 0 {
+		w.rec.Status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.rec.Status == 0 {
+		w.rec.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.rec.Size += n
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (app *App) withAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRegexp.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		rec := &accessRecord{
+			RequestID: id,
+			Host:      app.clientIP(r),
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			UserAgent: r.UserAgent(),
+		}
+		h.ServeHTTP(&loggingResponseWriter{w, rec}, r)
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.Time = start.Format(time.RFC3339)
+		rec.ReqTime = time.Since(start).Seconds()
+		app.AccessLog.write(rec)
+		app.metrics.observeRequest(rec)
+	})
+}
+
+// accessRecordOf returns the record being built for the request w answers,
+// or nil outside withAccessLog.
+func accessRecordOf(w http.ResponseWriter) *accessRecord {
+	if lw, ok := w.(*loggingResponseWriter); ok {
+		return lw.rec
+	}
+	return nil
+}
+
+func setAccessUser(w http.ResponseWriter, userId int) {
+	if rec := accessRecordOf(w); rec != nil {
+		rec.User = userId
+	}
+}
+
+func requestID(w http.ResponseWriter) string {
+	if rec := accessRecordOf(w); rec != nil {
+		return rec.RequestID
+	}
+	return ""
+}
+
+// logError logs err tagged with the request ID.
+func logError(w http.ResponseWriter, err error) {
+	logErrorID(requestID(w), err)
+}
+
+// logErrorID is logError for code that has the request ID but not the
+// ResponseWriter, such as templates and work that outlives the request.
+func logErrorID(id string, err error) {
+	if id != "" {
+		log.Printf("error: [%s] %s", id, err)
+	} else {
+		log.Printf("error: %s", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func withTestAccessLog(app *App, format string) *bytes.Buffer {
+	var buf bytes.Buffer
+	app.AccessLog = &accessLogger{format: format, w: &buf}
+	return &buf
+}
+
+func TestAccessLogLTSV(t *testing.T) {
+	app := newTestApp(t, nil)
+	buf := withTestAccessLog(app, "ltsv")
+	h := app.withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAccessUser(w, 7)
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	}))
+	r := httptest.NewRequest("GET", "/memo/1?x=1", nil)
+	r.Header.Set("User-Agent", "bench\tmark")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	id := w.Header().Get(requestIDHeader)
+	if len(id) != 32 {
+		t.Fatalf("generated request id %q", id)
+	}
+	line := buf.String()
+	for _, want := range []string{"reqid:" + id, "method:GET", "uri:/memo/1?x=1", "status:418", "size:5", "user:7", "ua:bench mark"} {
+		if !strings.Contains(line, want+"\t") && !strings.HasSuffix(line, want+"\n") {
+			t.Errorf("access log %q lacks %q", line, want)
+		}
+	}
+	if strings.Count(line, "\t") != 10 {
+		t.Errorf("access log has %d fields, want 11", strings.Count(line, "\t")+1)
+	}
+}
+
+func TestAccessLogRequestIDAndServerError(t *testing.T) {
+	app := newTestApp(t, nil)
+	buf := withTestAccessLog(app, "json")
+	h := app.withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverError(w, errors.New("boom"))
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(requestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if got := w.Header().Get(requestIDHeader); got != "abc-123" {
+		t.Errorf("request id = %q, want the incoming one", got)
+	}
+	if !strings.Contains(w.Body.String(), "abc-123") {
+		t.Errorf("500 body %q lacks the request id", w.Body.String())
+	}
+	var rec accessRecord
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.RequestID != "abc-123" || rec.Status != 500 {
+		t.Errorf("access record = %+v", rec)
+	}
+
+	r.Header.Set(requestIDHeader, "not ok\n")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get(requestIDHeader); got == "not ok\n" || got == "" {
+		t.Errorf("bad incoming request id was kept: %q", got)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"./sessions"
+	"github.com/gorilla/mux"
+)
+
+// JSON API mounted under /api/v1. Clients authenticate with the session
+// cookie the HTML pages use or with a personal access token (see
+// tokens.go); every response, including errors, is JSON.
+
+type apiErrorBody struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type apiMemoList struct {
+	Memos   Memos `json:"memos"`
+	Page    int   `json:"page"`
+	PerPage int   `json:"per_page"`
+	Total   int   `json:"total"`
+}
+
+type apiMemoRequest struct {
+	Content   string   `json:"content"`
+	IsPrivate bool     `json:"is_private"`
+	Tags      []string `json:"tags"`
+}
+
+func apiJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logError(w, err)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, message string) {
+	apiJSON(w, code, &apiErrorBody{Error: message})
+}
+
+func apiServerError(w http.ResponseWriter, err error) {
+	logError(w, err)
+	code := http.StatusInternalServerError
+	apiJSON(w, code, &apiErrorBody{Error: http.StatusText(code), RequestID: requestID(w)})
+}
+
+func apiUnauthorized(w http.ResponseWriter, r *http.Request) {
+	message := "authentication required"
+	if bearerToken(r) != "" {
+		message = "invalid token or insufficient scope"
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	apiError(w, http.StatusUnauthorized, message)
+}
+
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusNotFound
+	apiError(w, code, http.StatusText(code))
+}
+
+// apiCSRF is antiCSRF for JSON clients, which send the session token in
+// the X-CSRF-Token header instead of the sid form field.
+func apiCSRF(w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
+	if bearerToken(r) != "" {
+		return false
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.FormValue("sid")
+	}
+	if token == "" || token != session.Values["token"] {
+		code := http.StatusBadRequest
+		apiError(w, code, "invalid csrf token")
+		return true
+	}
+	return false
+}
+
+func (app *App) apiMemosHandler(w http.ResponseWriter, r *http.Request) {
+	page := 0
+	if p := r.FormValue("page"); p != "" {
+		var err error
+		if page, err = strconv.Atoi(p); err != nil || page < 0 {
+			apiError(w, http.StatusBadRequest, "invalid page")
+			return
+		}
+	}
+
+	memoIds, err := app.Index.PublicMemos(app.MemosPerPage*page, app.MemosPerPage)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	memos, err := app.lookupMemoMulti(memoIds)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	totalCount, err := app.publicMemoCount()
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	apiJSON(w, http.StatusOK, &apiMemoList{
+		Memos:   memos,
+		Page:    page,
+		PerPage: app.MemosPerPage,
+		Total:   totalCount,
+	})
+}
+
+func (app *App) apiMemoHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	vars := mux.Vars(r)
+	memoId, _ := strconv.Atoi(vars["memo_id"])
+	user, err := app.lookupUser(w, r, session)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	memo, err := app.Memos.Memo(memoId)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	if memo == nil || (memo.IsPrivate == 1 && (user == nil || user.Id != memo.User)) {
+		apiNotFoundHandler(w, r)
+		return
+	}
+	memo.Username = app.getUserName(memo.User)
+	apiJSON(w, http.StatusOK, memo)
+}
+
+func (app *App) apiMeHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	user, err := app.lookupUser(w, r, session)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	if user == nil {
+		apiUnauthorized(w, r)
+		return
+	}
+	apiJSON(w, http.StatusOK, user)
+}
+
+func (app *App) apiMyMemosHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	user, err := app.lookupUser(w, r, session)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	if user == nil {
+		apiUnauthorized(w, r)
+		return
+	}
+
+	memoIds, err := app.Index.UserMemos(user.Id)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	memos, err := app.lookupMemoMulti(memoIds)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, &apiMemoList{
+		Memos:   memos,
+		PerPage: len(memos),
+		Total:   len(memos),
+	})
+}
+
+func (app *App) apiMemoPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	user, err := app.lookupUser(w, r, session)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	if user == nil {
+		apiUnauthorized(w, r)
+		return
+	}
+	if apiCSRF(w, r, session) {
+		return
+	}
+
+	var req apiMemoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	var isPrivate int
+	if req.IsPrivate {
+		isPrivate = 1
+	}
+	tags := memoTags(req.Content, strings.Join(req.Tags, " "))
+	newId, err := app.createMemo(w, user.Id, req.Content, isPrivate, tags)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	memo, err := app.Memos.Memo(newId)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	if memo == nil {
+		apiNotFoundHandler(w, r)
+		return
+	}
+	memo.Username = user.Username
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/memos/%d", newId))
+	apiJSON(w, http.StatusCreated, memo)
+}
@@ -1,73 +1,48 @@
 package main
 
 import (
-	"crypto/md5"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"./passwords"
 	"./sessions"
 	"github.com/garyburd/redigo/redis"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	goCache "github.com/pmylund/go-cache"
-	"github.com/russross/blackfriday"
 )
 
-const (
-	maxConnectionCount = 256
-	memosPerPage       = 100
-	listenAddr         = ":5000"
-	sessionName        = "isucon_session"
-	tmpDir             = "/tmp/"
-	dbConnPoolSize     = 10
-	memcachedServer    = "localhost:11212"
-	sessionSecret      = "kH<{11qpic*gf0e21YK7YtwyUvE9l<1r>yX8R-Op"
-)
-
-type Config struct {
-	Database struct {
-		Dbname   string `json:"dbname"`
-		Host     string `json:"host"`
-		Port     int    `json:"port"`
-		Username string `json:"username"`
-		Password string `json:"password"`
-	} `json:"database"`
-}
-
 type User struct {
-	Id         int
-	Username   string
-	Password   string
-	Salt       string
-	LastAccess string
+	Id         int    `json:"id"`
+	Username   string `json:"username"`
+	Password   string `json:"-"`
+	Salt       string `json:"-"`
+	LastAccess string `json:"last_access"`
 }
 
 type Memo struct {
-	Id        int
-	User      int
-	Content   string
-	IsPrivate int
-	CreatedAt string
-	UpdatedAt string
-	Username  string
+	Id        int      `json:"id"`
+	User      int      `json:"user"`
+	Content   string   `json:"content"`
+	IsPrivate int      `json:"is_private"`
+	CreatedAt string   `json:"created_at"`
+	UpdatedAt string   `json:"updated_at"`
+	DeletedAt string   `json:"deleted_at,omitempty"`
+	Username  string   `json:"username"`
+	Tags      []string `json:"tags,omitempty"`
 }
 
 type Memos []*Memo
@@ -79,160 +54,368 @@ type View struct {
 	Page      int
 	PageStart int
 	PageEnd   int
+	HasNext   bool
+	Capped    bool
 	Total     int
 	Older     *Memo
 	Newer     *Memo
+	Tokens    []*APIToken
+	NewToken  string
+	Query     string
+	Results   []*SearchResult
+	Tag       string
+	TagCloud  []*TagCount
+	Errors    []string
+	Flashes   []string
+	Form      map[string]string
 	Session   *sessions.Session
+	BaseURL   string
+	RequestID string
 }
 
-var (
-	dbConnPool chan *sql.DB
-	baseUrl    *url.URL
-	fmap       = template.FuncMap{
-		"url_for": func(path string) string {
-			return baseUrl.String() + path
-		},
-		"first_line": func(s string) string {
-			sl := strings.Split(s, "\n")
-			return sl[0]
+// App holds everything a handler needs. Handlers are methods on it, so
+// several Apps with different backends can live in one process, as they
+// do in the tests. DB and Redis are nil with the "memory" storage.
+type App struct {
+	DB          *sql.DB
+	Redis       *redis.Pool
+	RedisConfig RedisConfig
+	Users       UserRepository
+	Memos       MemoRepository
+	Index       MemoIndex
+	Sessions    sessions.Store
+	SessionName string
+	Templates   *template.Template
+
+	MemosPerPage   int
+	TrashRetention time.Duration
+	PasswordPolicy PasswordPolicy
+	LoginThrottle  LoginThrottle
+	Hasher         *passwords.Policy
+	TrustedProxies []*net.IPNet
+	AccessLog      *accessLogger
+	Renderer       markdownRenderer
+	Sanitizer      *htmlSanitizer
+
+	// dummyPasswordHash is verified against when the username does not
+	// exist so that unknown and known usernames take the same time.
+	dummyPasswordHash string
+
+	cache    *goCache.Cache
+	metrics  *metrics
+	throttle throttleStore
+
+	// renders and sharedRenders are the tiers of the Markdown cache; see
+	// render_cache.go. sharedRenders is nil unless render_cache.shared is
+	// set.
+	renders       *lruCache
+	sharedRenders sharedRenderCache
+	renderVersion string
+	warmWorkers   int
+
+	// names maps user id to username. It is filled by initNames and
+	// extended by signupPostHandler, so it grows as needed.
+	namesMu     sync.RWMutex
+	names       []string
+	namesLoaded int32
+	draining    int32
+}
+
+var port = flag.Uint("port", 0, "TCP port to listen on, overriding server.listen")
+
+// NewApp builds an App from config. Nothing is dialled yet: MySQL, Redis
+// and memcache are connected to on first use.
+func NewApp(config *Config) (*App, error) {
+	renderCache := config.RenderCache.withDefaults()
+	app := &App{
+		RedisConfig:    config.Redis,
+		SessionName:    config.Sessions.Name,
+		MemosPerPage:   config.Pagination.MemosPerPage,
+		TrashRetention: trashRetention(config),
+		PasswordPolicy: config.PasswordPolicy.withDefaults(),
+		LoginThrottle:  config.LoginThrottle.withDefaults(),
+		cache:          goCache.New(30*time.Second, 10*time.Second),
+		renders:        newLRUCache(renderCache.MaxBytes),
+		warmWorkers:    renderCache.WarmWorkers,
+		names:          make([]string, 500),
+	}
+	var err error
+	if config.Storage == storageMemory {
+		app.Users = newMemUsers()
+		app.Memos = newMemMemos()
+		app.Index = newMemIndex()
+		app.throttle = newMemThrottleStore()
+		app.metrics = newMetrics(app)
+		app.Sessions = sessions.NewCookieStore([]byte(config.Sessions.Secret))
+	} else {
+		db := config.Database
+		dsn := fmt.Sprintf(
+			"%s:%s@tcp(%s:%d)/%s?charset=utf8",
+			db.Username, db.Password, db.Host, db.Port, db.Dbname,
+		)
+		if app.DB, err = openDB(dsn, db); err != nil {
+			return nil, err
+		}
+		app.Redis = newRedisPool(app.RedisConfig)
+		app.Users = &mysqlUsers{app.DB}
+		app.Memos = &mysqlMemos{app.DB}
+		wait := ms(app.RedisConfig.WaitTimeoutMs)
+		app.Index = &redisIndex{app.Redis, wait}
+		app.throttle = &redisThrottleStore{app.Redis, wait}
+		app.metrics = newMetrics(app)
+		store := sessions.NewMemcacheStore(config.Memcache.Addr, []byte(config.Sessions.Secret))
+		store.Observe = app.metrics.observeSessionStore
+		app.Sessions = store
+	}
+
+	if app.Templates, err = app.parseTemplates("templates/*.html"); err != nil {
+		app.Close()
+		return nil, err
+	}
+	proxies := config.TrustedProxies
+	if proxies == nil {
+		proxies = defaultTrustedProxies
+	}
+	if app.TrustedProxies, err = parseCIDRs(proxies); err != nil {
+		app.Close()
+		return nil, err
+	}
+	if app.AccessLog, err = newAccessLogger(config.AccessLog); err != nil {
+		app.Close()
+		return nil, err
+	}
+	if app.Renderer, err = newMarkdownRenderer(config.Markdown); err != nil {
+		app.Close()
+		return nil, err
+	}
+	if app.Sanitizer, err = newHTMLSanitizer(config.Sanitize); err != nil {
+		app.Close()
+		return nil, err
+	}
+	app.renderVersion = renderCacheVersion(app.Renderer, config.Sanitize)
+	if app.sharedRenders, err = newSharedRenderCache(renderCache, app.Redis, ms(app.RedisConfig.WaitTimeoutMs), config.Memcache.Addr); err != nil {
+		app.Close()
+		return nil, err
+	}
+	hasher, err := newPasswordHasher(config.PasswordHash)
+	if err == nil {
+		err = app.setPasswordHasher(hasher)
+	}
+	if err != nil {
+		app.Close()
+		return nil, err
+	}
+	return app, nil
+}
+
+// Close releases the database and Redis connections, if any.
+func (app *App) Close() error {
+	if app.Redis != nil {
+		app.Redis.Close()
+	}
+	if app.DB != nil {
+		return app.DB.Close()
+	}
+	return nil
+}
+
+func (app *App) parseTemplates(pattern string) (*template.Template, error) {
+	fmap := template.FuncMap{
+		"url_for": func(base, path string) string {
+			return base + path
 		},
+		"first_line": firstLine,
 		"get_token": func(session *sessions.Session) interface{} {
+			if session == nil {
+				return nil
+			}
 			return session.Values["token"]
 		},
-		"gen_markdown": func(s string) template.HTML {
-			h, found := getHTML(s)
-			if found {
-				return h
-			}
-			out := blackfriday.MarkdownCommon([]byte(s))
-			return template.HTML(out)
+		"gen_markdown": app.genMarkdown,
+		"join":         strings.Join,
+		"add": func(a, b int) int {
+			return a + b
 		},
 	}
-	tmpl = template.Must(template.New("tmpl").Funcs(fmap).ParseGlob("templates/*.html"))
-)
+	return template.New("tmpl").Funcs(fmap).ParseGlob(pattern)
+}
 
-var port = flag.Uint("port", 0, "port to listen")
-var gocache = goCache.New(30*time.Second, 10*time.Second)
+// Router returns the handler for the public listener. When admin is false
+// /metrics and /debug/* are mounted on it for loopback clients; otherwise
+// they are left to AdminHandler.
+func (app *App) Router(admin bool) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/", app.topHandler)
+	r.HandleFunc("/signin", app.signinHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/signin", app.signinPostHandler).Methods("POST")
+	r.HandleFunc("/signout", app.signoutHandler)
+	r.HandleFunc("/signup", app.signupHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/signup", app.signupPostHandler).Methods("POST")
+	r.HandleFunc("/mypage", app.mypageHandler)
+	r.HandleFunc("/memo/{memo_id}", app.memoHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/memo/{memo_id}", app.memoUpdateHandler).Methods("POST")
+	r.HandleFunc("/memo/{memo_id}/edit", app.memoEditHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/memo/{memo_id}/delete", app.memoDeleteHandler).Methods("POST")
+	r.HandleFunc("/trash", app.trashHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/trash/{memo_id}/restore", app.trashRestoreHandler).Methods("POST")
+	r.HandleFunc("/trash/{memo_id}/purge", app.trashPurgeHandler).Methods("POST")
+	r.HandleFunc("/tokens", app.tokenPostHandler).Methods("POST")
+	r.HandleFunc("/tokens/{token_id}/revoke", app.tokenRevokeHandler).Methods("POST")
+	r.HandleFunc("/memo", app.memoPostHandler).Methods("POST")
+	r.HandleFunc("/recent/{page:[0-9]+}", app.recentHandler)
+	r.HandleFunc("/tag/{tag}", app.tagHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/tag/{tag}/{page:[0-9]+}", app.tagHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/recent.atom", app.recentAtomHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/recent.rss", app.recentRSSHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/user/{username:[^/]+}.atom", app.userAtomHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/search", app.searchHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/init", app.initHandler)
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", app.readyzHandler).Methods("GET", "HEAD")
+
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/memos", app.apiMemosHandler).Methods("GET", "HEAD")
+	api.HandleFunc("/memos", app.apiMemoPostHandler).Methods("POST")
+	api.HandleFunc("/memos/{memo_id:[0-9]+}", app.apiMemoHandler).Methods("GET", "HEAD")
+	api.HandleFunc("/me", app.apiMeHandler).Methods("GET", "HEAD")
+	api.HandleFunc("/me/memos", app.apiMyMemosHandler).Methods("GET", "HEAD")
+	api.HandleFunc("/search", app.apiSearchHandler).Methods("GET", "HEAD")
+	api.NotFoundHandler = http.HandlerFunc(apiNotFoundHandler)
+
+	if !admin {
+		h := app.localOnly(app.AdminHandler())
+		r.Handle("/metrics", h).Methods("GET", "HEAD")
+		r.PathPrefix("/debug/").Handler(h).Methods("GET", "HEAD")
+	}
+
+	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
+	r.Use(recordRoute)
+	return app.withAccessLog(r)
+}
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
 
-	env := os.Getenv("ISUCON_ENV")
-	if env == "" {
-		env = "local"
-	}
-	config := loadConfig("../config/" + env + ".json")
-	db := config.Database
-	connectionString := fmt.Sprintf(
-		"%s:%s@tcp(%s:%d)/%s?charset=utf8",
-		db.Username, db.Password, db.Host, db.Port, db.Dbname,
-	)
-	log.Printf("db: %s", connectionString)
-
-	dbConnPool = make(chan *sql.DB, dbConnPoolSize)
-	for i := 0; i < dbConnPoolSize; i++ {
-		conn, err := sql.Open("mysql", connectionString)
-		if err != nil {
-			log.Panicf("Error opening database: %v", err)
+	if *highlightCSS != "" {
+		if err := writeHighlightCSS(os.Stdout, *highlightCSS); err != nil {
+			log.Fatal(err)
 		}
-		dbConnPool <- conn
-		defer conn.Close()
+		return
 	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/", topHandler)
-	r.HandleFunc("/signin", signinHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/signin", signinPostHandler).Methods("POST")
-	r.HandleFunc("/signout", signoutHandler)
-	r.HandleFunc("/mypage", mypageHandler)
-	r.HandleFunc("/memo/{memo_id}", memoHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/memo", memoPostHandler).Methods("POST")
-	r.HandleFunc("/recent/{page:[0-9]+}", recentHandler)
-	r.HandleFunc("/init", initHandler)
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
-	http.Handle("/", r)
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Storage == storageMemory {
+		log.Printf("storage: memory; nothing is persisted")
+	} else {
+		db := config.Database
+		log.Printf("db: %s@tcp(%s:%d)/%s", db.Username, db.Host, db.Port, db.Dbname)
+	}
 
-	sigchan := make(chan os.Signal)
-	signal.Notify(sigchan, os.Interrupt)
-	signal.Notify(sigchan, syscall.SIGTERM)
-	signal.Notify(sigchan, syscall.SIGINT)
+	app, err := NewApp(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app.Close()
 
-	var l net.Listener
-	var err error
-	if *port == 0 {
-		ferr := os.Remove("/tmp/server.sock")
-		if ferr != nil {
-			if !os.IsNotExist(ferr) {
-				panic(ferr.Error())
-			}
+	if *passwordReport {
+		if err := reportPasswordSchemes(app.Users, os.Stdout); err != nil {
+			log.Fatal(err)
 		}
-		l, err = net.Listen("unix", "/tmp/server.sock")
-		os.Chmod("/tmp/server.sock", 0777)
-	} else {
-		l, err = net.ListenTCP("tcp", &net.TCPAddr{Port: int(*port)})
+		return
 	}
-	if err != nil {
-		panic(err.Error())
+
+	var adminSrv *http.Server
+	if config.Server.AdminListen != "" {
+		adminSrv = &http.Server{Handler: app.AdminHandler()}
+		go serveAdmin(adminSrv, config.Server.AdminListen)
 	}
-	go func() {
-		log.Println(http.Serve(l, nil))
-	}()
 
-	<-sigchan
-}
+	go app.purgeTrashLoop(app.TrashRetention)
+	go app.loadNames()
 
-func loadConfig(filename string) *Config {
-	log.Printf("loading config file: %s", filename)
-	f, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+	network, addr, _ := config.listenAddr()
+	if *port != 0 {
+		network, addr = "tcp", fmt.Sprintf(":%d", *port)
 	}
-	var config Config
-	err = json.Unmarshal(f, &config)
+	l, err := listen(network, addr)
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		panic(err.Error())
+	}
+	srv := &http.Server{Handler: app.Router(adminSrv != nil)}
+	drain := time.Duration(config.Server.ShutdownTimeoutSeconds) * time.Second
+	if err := app.serve(srv, l, drain, adminSrv); err != nil && err != http.ErrServerClosed {
+		log.Println(err)
 	}
-	return &config
 }
 
-func prepareHandler(w http.ResponseWriter, r *http.Request) {
-	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
-		baseUrl, _ = url.Parse("http://" + h)
-	} else {
-		baseUrl, _ = url.Parse("http://" + r.Host)
+// baseURL is the scheme and host the client used, for absolute links.
+// X-Forwarded-Host is only believed from a trusted proxy.
+func (app *App) baseURL(r *http.Request) string {
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" && app.fromTrustedProxy(r) {
+		host = h
 	}
+	return "http://" + host
 }
 
-func loadSession(w http.ResponseWriter, r *http.Request) (session *sessions.Session, err error) {
-	store := sessions.NewMemcacheStore(memcachedServer, []byte(sessionSecret))
-	return store.Get(r, sessionName)
+// render executes the named template with the base URL of r filled in.
+func (app *App) render(w http.ResponseWriter, r *http.Request, name string, v *View) error {
+	v.BaseURL = app.baseURL(r)
+	v.RequestID = requestID(w)
+	return app.Templates.ExecuteTemplate(w, name, v)
 }
 
-func getUser(w http.ResponseWriter, r *http.Request, dbConn *sql.DB, session *sessions.Session) *User {
-	userId := session.Values["user_id"]
-	if userId == nil {
-		return nil
+func (app *App) loadSession(w http.ResponseWriter, r *http.Request) (session *sessions.Session, err error) {
+	session, err = app.Sessions.Get(r, app.SessionName)
+	if rec := accessRecordOf(w); rec != nil && session != nil {
+		rec.SessionNew = session.IsNew
 	}
-	user := &User{}
-	rows, err := dbConn.Query("SELECT * FROM users WHERE id=?", userId)
+	return session, err
+}
+
+// getUser returns the signed-in user, or nil. On an error it writes a 500
+// page, so API handlers use lookupUser instead.
+func (app *App) getUser(w http.ResponseWriter, r *http.Request, session *sessions.Session) *User {
+	user, err := app.lookupUser(w, r, session)
 	if err != nil {
 		serverError(w, err)
 		return nil
 	}
-	if rows.Next() {
-		rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt, &user.LastAccess)
-		rows.Close()
+	return user
+}
+
+// lookupUser returns the user of the bearer token in r or else of
+// session, or nil if there is none.
+func (app *App) lookupUser(w http.ResponseWriter, r *http.Request, session *sessions.Session) (*User, error) {
+	var user *User
+	var err error
+	if token := bearerToken(r); token != "" {
+		user, err = app.getTokenUser(r, token)
+	} else if userId := session.Values["user_id"]; userId != nil {
+		id, _ := userId.(int)
+		user, err = app.Users.User(id)
+	}
+	if err != nil {
+		return nil, err
 	}
 	if user != nil {
 		w.Header().Add("Cache-Control", "private")
+		setAccessUser(w, user.Id)
 	}
-	return user
+	return user, nil
 }
 
+// antiCSRF reports whether the request was rejected. Requests carrying a
+// bearer token are never authenticated by the session cookie, so they
+// need no CSRF token.
 func antiCSRF(w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
+	if bearerToken(r) != "" {
+		return false
+	}
 	if r.FormValue("sid") != session.Values["token"] {
 		code := http.StatusBadRequest
 		http.Error(w, http.StatusText(code), code)
@@ -242,9 +425,13 @@ func antiCSRF(w http.ResponseWriter, r *http.Request, session *sessions.Session)
 }
 
 func serverError(w http.ResponseWriter, err error) {
-	log.Printf("error: %s", err)
+	logError(w, err)
 	code := http.StatusInternalServerError
-	http.Error(w, http.StatusText(code), code)
+	msg := http.StatusText(code)
+	if id := requestID(w); id != "" {
+		msg += " (request id: " + id + ")"
+	}
+	http.Error(w, msg, code)
 }
 
 func notFound(w http.ResponseWriter) {
@@ -252,42 +439,35 @@ func notFound(w http.ResponseWriter) {
 	http.Error(w, http.StatusText(code), code)
 }
 
-func topHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := loadSession(w, r)
+func forbidden(w http.ResponseWriter) {
+	code := http.StatusForbidden
+	http.Error(w, http.StatusText(code), code)
+}
+
+func (app *App) topHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
-	user := getUser(w, r, dbConn, session)
+	user := app.getUser(w, r, session)
 
-	var totalCount int
-	rdb, err := connectRedis()
-	defer rdb.Close()
+	memoIds, err := app.Index.PublicMemos(0, app.MemosPerPage)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-
-	memoIds, err := redis.Strings(rdb.Do("LRANGE", "public_memo_list", 0, memosPerPage-1))
-	x, found := gocache.Get("public_memo_count")
-	if found {
-		// fmt.Println("HIT")
-		totalCount = x.(int)
-	} else {
-		// fmt.Println("NO HIT")
-		totalCount, err = redis.Int(rdb.Do("LLEN", "public_memo_list"))
-		if err != nil {
-			serverError(w, err)
-			return
-		}
-		gocache.Set("public_memo_count", totalCount, 30*time.Second)
+	totalCount, err := app.publicMemoCount()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	memos, err := app.lookupMemoMulti(memoIds)
+	if err != nil {
+		serverError(w, err)
+		return
 	}
-	memos, err := lookupMemoMulti(dbConn, memoIds)
+	cloud, err := app.Index.TagCloud()
 	if err != nil {
 		serverError(w, err)
 		return
@@ -297,61 +477,44 @@ func topHandler(w http.ResponseWriter, r *http.Request) {
 		Total:     totalCount,
 		Page:      0,
 		PageStart: 1,
-		PageEnd:   memosPerPage,
+		PageEnd:   app.MemosPerPage,
 		Memos:     &memos,
+		TagCloud:  cloud,
 		User:      user,
 		Session:   session,
 	}
-	if err = tmpl.ExecuteTemplate(w, "index", v); err != nil {
+	if err = app.render(w, r, "index", v); err != nil {
 		serverError(w, err)
 	}
 }
 
-func recentHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := loadSession(w, r)
+func (app *App) recentHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
-	user := getUser(w, r, dbConn, session)
+	user := app.getUser(w, r, session)
 	vars := mux.Vars(r)
 	page, _ := strconv.Atoi(vars["page"])
 
-	rdb, err := connectRedis()
+	memoIds, err := app.Index.PublicMemos(app.MemosPerPage*page, app.MemosPerPage)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	defer rdb.Close()
-	memoIds, err := redis.Strings(rdb.Do("LRANGE", "public_memo_list", memosPerPage*page, memosPerPage*(page+1)-1))
+	memos, err := app.lookupMemoMulti(memoIds)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	memos, err := lookupMemoMulti(dbConn, memoIds)
+
+	totalCount, err := app.publicMemoCount()
 	if err != nil {
 		serverError(w, err)
 		return
 	}
 
-	var totalCount int
-	x, found := gocache.Get("public_memo_count")
-	if found {
-		// fmt.Println("HIT")
-		totalCount = x.(int)
-	} else {
-		totalCount, err = redis.Int(rdb.Do("LLEN", "public_memo_list"))
-		if err != nil {
-			serverError(w, err)
-		}
-		gocache.Set("public_memo_count", totalCount, 30*time.Second)
-	}
-
 	if len(memos) == 0 {
 		notFound(w)
 		return
@@ -360,218 +523,261 @@ func recentHandler(w http.ResponseWriter, r *http.Request) {
 	v := &View{
 		Total:     totalCount,
 		Page:      page,
-		PageStart: memosPerPage*page + 1,
-		PageEnd:   memosPerPage * (page + 1),
+		PageStart: app.MemosPerPage*page + 1,
+		PageEnd:   app.MemosPerPage * (page + 1),
 		Memos:     &memos,
 		User:      user,
 		Session:   session,
 	}
-	if err = tmpl.ExecuteTemplate(w, "index", v); err != nil {
+	if err = app.render(w, r, "index", v); err != nil {
 		serverError(w, err)
 	}
 }
 
-func initHandler(w http.ResponseWriter, r *http.Request) {
-	gocache.Flush()
+func (app *App) initHandler(w http.ResponseWriter, r *http.Request) {
+	app.cache.Flush()
 
-	err := initNames()
+	err := app.initNames()
 	if err != nil {
 		serverError(w, err)
+		return
 	}
 
-	err = migrateToRedis()
+	err = app.rebuildIndex(requestID(w))
 	if err != nil {
 		serverError(w, err)
+		return
 	}
 
 	w.Write([]byte("ok"))
 }
 
-var names [500]string
-
-func initNames() error {
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
-
-	rows, err := dbConn.Query("SELECT id, username FROM users ORDER BY id ASC")
+func (app *App) initNames() error {
+	users, err := app.Users.Users()
 	if err != nil {
 		return err
 	}
-	for rows.Next() {
-		var Id int
-		var Name string
-		rows.Scan(&Id, &Name)
-		log.Printf("%d\t%s", Id, Name)
-		names[Id] = Name
+	for _, u := range users {
+		log.Printf("%d\t%s", u.Id, u.Username)
+		app.setUserName(u.Id, u.Username)
 	}
-	rows.Close()
+	atomic.StoreInt32(&app.namesLoaded, 1)
 	return nil
 }
 
-func getUserName(id int) string {
-	return names[id]
+func (app *App) setUserName(id int, name string) {
+	app.namesMu.Lock()
+	defer app.namesMu.Unlock()
+	if id >= len(app.names) {
+		grown := make([]string, id*2)
+		copy(grown, app.names)
+		app.names = grown
+	}
+	app.names[id] = name
 }
 
-func signinHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := loadSession(w, r)
+func (app *App) getUserName(id int) string {
+	app.namesMu.RLock()
+	defer app.namesMu.RUnlock()
+	if id < 0 || id >= len(app.names) {
+		return ""
+	}
+	return app.names[id]
+}
+
+func (app *App) signinHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
-	user := getUser(w, r, dbConn, session)
+	user := app.getUser(w, r, session)
 
 	v := &View{
 		User:    user,
 		Session: session,
 	}
-	if err := tmpl.ExecuteTemplate(w, "signin", v); err != nil {
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		for _, f := range flashes {
+			if msg, ok := f.(string); ok {
+				v.Flashes = append(v.Flashes, msg)
+			}
+		}
+		if err = session.Save(r, w); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+	if err := app.render(w, r, "signin", v); err != nil {
 		serverError(w, err)
 		return
 	}
 }
 
-func signinPostHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := loadSession(w, r)
+func (app *App) signinPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
-	user := &User{}
-	rows, err := dbConn.Query("SELECT id, username, password, salt FROM users WHERE username=?", username)
+	ip := app.clientIP(r)
+
+	if wait, err := app.LoginThrottle.wait(app.throttle, username, ip); err != nil {
+		serverError(w, err)
+		return
+	} else if wait > 0 {
+		signinFailed(w, r, session, throttleMessage(wait))
+		return
+	}
+
+	user, err := app.Users.UserByName(username)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	if rows.Next() {
-		rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt)
+	ok, err := app.checkPassword(w, user, password)
+	if err != nil {
+		serverError(w, err)
+		return
 	}
-	rows.Close()
-	if user.Id > 0 {
-		h := sha256.New()
-		h.Write([]byte(user.Salt + password))
-		if user.Password == fmt.Sprintf("%x", h.Sum(nil)) {
-			session.Values["user_id"] = user.Id
-			session.Values["token"] = fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
-			if err := session.Save(r, w); err != nil {
-				serverError(w, err)
-				return
-			}
-			if _, err := dbConn.Exec("UPDATE users SET last_access=now() WHERE id=?", user.Id); err != nil {
-				serverError(w, err)
-				return
-			} else {
-				http.Redirect(w, r, "/mypage", http.StatusFound)
-			}
+	if ok {
+		if err := app.LoginThrottle.reset(app.throttle, username); err != nil {
+			serverError(w, err)
+			return
+		}
+		if err := startSession(r, w, session, user.Id); err != nil {
+			serverError(w, err)
 			return
 		}
+		if err := app.Users.TouchUser(user.Id); err != nil {
+			serverError(w, err)
+			return
+		} else {
+			http.Redirect(w, r, "/mypage", http.StatusFound)
+		}
+		return
 	}
-	v := &View{
-		Session: session,
+	wait, err := app.LoginThrottle.fail(app.throttle, username, ip)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if wait > 0 {
+		signinFailed(w, r, session, throttleMessage(wait))
+	} else {
+		signinFailed(w, r, session, "Wrong username or password.")
 	}
-	if err := tmpl.ExecuteTemplate(w, "signin", v); err != nil {
+}
+
+// signinFailed sends the user back to the sign-in form with msg flashed.
+func signinFailed(w http.ResponseWriter, r *http.Request, session *sessions.Session, msg string) {
+	session.AddFlash(msg)
+	if err := session.Save(r, w); err != nil {
 		serverError(w, err)
 		return
 	}
+	http.Redirect(w, r, "/signin", http.StatusSeeOther)
+}
+
+// startSession marks session as signed in as userId with a fresh CSRF
+// token and saves it.
+func startSession(r *http.Request, w http.ResponseWriter, session *sessions.Session, userId int) error {
+	session.Values["user_id"] = userId
+	session.Values["token"] = fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+	return session.Save(r, w)
 }
 
-func signoutHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := loadSession(w, r)
+func (app *App) signoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
 	if antiCSRF(w, r, session) {
 		return
 	}
 
-	http.SetCookie(w, sessions.NewCookie(sessionName, "", &sessions.Options{MaxAge: -1}))
+	http.SetCookie(w, sessions.NewCookie(app.SessionName, "", &sessions.Options{MaxAge: -1}))
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func mypageHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := loadSession(w, r)
+func (app *App) mypageHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
 
-	user := getUser(w, r, dbConn, session)
+	user := app.getUser(w, r, session)
 	if user == nil {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	rdb, err := connectRedis()
+	app.renderMypage(w, r, session, user, "")
+}
+
+// renderMypage renders user's mypage, showing newToken if it is not empty.
+func (app *App) renderMypage(w http.ResponseWriter, r *http.Request, session *sessions.Session, user *User, newToken string) {
+	tag := normalizeTag(r.FormValue("tag"))
+	var memoIds []int
+	var err error
+	if tag != "" {
+		memoIds, err = app.Index.UserTagMemos(user.Id, tag)
+	} else {
+		memoIds, err = app.Index.UserMemos(user.Id)
+	}
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	defer rdb.Close()
-	memoIds, err := redis.Strings(rdb.Do("LRANGE", fmt.Sprintf("user_memo_list:%d", user.Id), 0, -1))
+	memos, err := app.lookupMemoMulti(memoIds)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	memos, err := lookupMemoMulti(dbConn, memoIds)
+	cloud, err := app.Index.UserTagCloud(user.Id)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	v := &View{
-		Memos:   &memos,
-		User:    user,
-		Session: session,
+	tokens, err := app.Users.Tokens(user.Id)
+	if err != nil {
+		serverError(w, err)
+		return
 	}
-	if err = tmpl.ExecuteTemplate(w, "mypage", v); err != nil {
+	v := &View{
+		Memos:    &memos,
+		User:     user,
+		Tokens:   tokens,
+		Tag:      tag,
+		TagCloud: cloud,
+		NewToken: newToken,
+		Session:  session,
+	}
+	if err = app.render(w, r, "mypage", v); err != nil {
 		serverError(w, err)
 	}
 }
 
-func memoHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := loadSession(w, r)
+func (app *App) memoHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
 	vars := mux.Vars(r)
-	memoId := vars["memo_id"]
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
-	user := getUser(w, r, dbConn, session)
+	memoId, _ := strconv.Atoi(vars["memo_id"])
+	user := app.getUser(w, r, session)
 
-	rows, err := dbConn.Query("SELECT id, user, content, is_private, created_at, updated_at FROM memos WHERE id=?", memoId)
+	memo, err := app.Memos.Memo(memoId)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	memo := &Memo{}
-	if rows.Next() {
-		rows.Scan(&memo.Id, &memo.User, &memo.Content, &memo.IsPrivate, &memo.CreatedAt, &memo.UpdatedAt)
-		rows.Close()
-	} else {
+	if memo == nil {
 		notFound(w)
 		return
 	}
@@ -581,39 +787,22 @@ func memoHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	memo.Username = getUserName(memo.User)
+	memo.Username = app.getUserName(memo.User)
 
-	memos := make(Memos, 0)
+	var memos Memos
 	if user != nil && user.Id == memo.User {
-		rdb, err := connectRedis()
-		defer rdb.Close()
-		if err != nil {
-			serverError(w, err)
-			return
-		}
-		memoIds, err := redis.Strings(rdb.Do("LRANGE", fmt.Sprintf("user_memo_list:%d", user.Id), 0, -1))
-		if err != nil {
-			serverError(w, err)
-			return
-		}
-		memos, err = lookupMemoMulti(dbConn, memoIds)
+		memoIds, err := app.Index.UserMemos(user.Id)
 		if err != nil {
 			serverError(w, err)
 			return
 		}
+		memos, err = app.lookupMemoMulti(memoIds)
 	} else {
-		cond := "AND is_private=0"
-		rows, err = dbConn.Query("SELECT id, content, is_private, created_at, updated_at FROM memos WHERE user=? "+cond+" ORDER BY created_at", memo.User)
-		if err != nil {
-			serverError(w, err)
-			return
-		}
-		for rows.Next() {
-			m := Memo{}
-			rows.Scan(&m.Id, &m.Content, &m.IsPrivate, &m.CreatedAt, &m.UpdatedAt)
-			memos = append(memos, &m)
-		}
-		rows.Close()
+		memos, err = app.Memos.PublicMemosOf(memo.User)
+	}
+	if err != nil {
+		serverError(w, err)
+		return
 	}
 	var older *Memo
 	var newer *Memo
@@ -635,27 +824,22 @@ func memoHandler(w http.ResponseWriter, r *http.Request) {
 		Newer:   newer,
 		Session: session,
 	}
-	if err = tmpl.ExecuteTemplate(w, "memo", v); err != nil {
+	if err = app.render(w, r, "memo", v); err != nil {
 		serverError(w, err)
 	}
 }
 
-func memoPostHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := loadSession(w, r)
+func (app *App) memoPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
 	if antiCSRF(w, r, session) {
 		return
 	}
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
 
-	user := getUser(w, r, dbConn, session)
+	user := app.getUser(w, r, session)
 	if user == nil {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
@@ -663,158 +847,191 @@ func memoPostHandler(w http.ResponseWriter, r *http.Request) {
 	var isPrivate int
 	if r.FormValue("is_private") == "1" {
 		isPrivate = 1
-	} else {
-		gocache.Increment("public_memo_count", 1)
-		isPrivate = 0
 	}
-	result, err := dbConn.Exec(
-		"INSERT INTO memos (user, content, is_private, created_at) VALUES (?, ?, ?, now())",
-		user.Id, r.FormValue("content"), isPrivate,
-	)
+	content := r.FormValue("content")
+	tags := memoTags(content, r.FormValue("tags"))
+	newId, err := app.createMemo(w, user.Id, content, isPrivate, tags)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	newId, _ := result.LastInsertId()
-	rdb, err := connectRedis()
-	if err != nil {
-		serverError(w, err)
-		return
+	http.Redirect(w, r, fmt.Sprintf("/memo/%d", newId), http.StatusFound)
+}
+
+// createMemo stores a memo and adds it to the index that memoHandler,
+// mypageHandler and the public listings read. A failure to index is only
+// logged against the request w answers.
+func (app *App) createMemo(w http.ResponseWriter, userId int, content string, isPrivate int, tags []string) (int, error) {
+	memo := &Memo{User: userId, Content: content, IsPrivate: isPrivate, Tags: tags}
+	if err := app.Memos.CreateMemo(memo); err != nil {
+		return 0, err
 	}
-	rdb.Send("MULTI")
-	rdb.Send("RPUSH", fmt.Sprintf("user_memo_list:%d", user.Id), newId)
 	if isPrivate == 0 {
-		rdb.Send("LPUSH", "public_memo_list", newId)
-		rdb.Send("LPUSH", fmt.Sprintf("user_public_memo_list:%d", user.Id), newId)
+		app.cache.Increment("public_memo_count", 1)
 	}
-	_, err = rdb.Do("EXEC")
-	if err != nil {
-		fmt.Errorf(err.Error())
+	if err := app.Index.Add(memo); err != nil {
+		logError(w, fmt.Errorf("memo %d: %s", memo.Id, err))
 	}
-	cacheHTML(r.FormValue("content"))
-	http.Redirect(w, r, fmt.Sprintf("/memo/%d", newId), http.StatusFound)
-}
-
-func connectRedis() (redis.Conn, error) {
-	c, err := redis.Dial("tcp", ":6379")
-	return c, err
+	app.cacheHTML(requestID(w), content)
+	return memo.Id, nil
 }
 
-func migrateToRedis() error {
-	r, err := connectRedis()
+func (app *App) memoEditHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
 	if err != nil {
-		panic(err)
+		serverError(w, err)
+		return
 	}
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
+	vars := mux.Vars(r)
+	memoId, _ := strconv.Atoi(vars["memo_id"])
 
-	cursor := 0
-	r.Do("FLUSHDB")
-	for {
-		rows, err := dbConn.Query("SELECT * FROM memos WHERE id > ? ORDER BY id ASC LIMIT 2000", cursor)
-		if err != nil {
-			return err
-		}
-		r.Send("MULTI")
-		rowsCount := 0
-		for rows.Next() {
-			memo := Memo{}
-			rows.Scan(&memo.Id, &memo.User, &memo.Content, &memo.IsPrivate, &memo.CreatedAt, &memo.UpdatedAt)
-			if memo.IsPrivate == 0 {
-				r.Send("LPUSH", "public_memo_list", memo.Id)
-				r.Send("RPUSH", fmt.Sprintf("user_public_memo_list:%d", memo.User), memo.Id)
-			}
-			r.Send("RPUSH", fmt.Sprintf("user_memo_list:%d", memo.User), memo.Id)
-			rowsCount++
-			go cacheHTML(memo.Content)
-		}
-		_, err = r.Do("EXEC")
-		if err != nil {
-			fmt.Errorf(err.Error())
-		}
-		if rowsCount < 1000 {
-			break
-		}
-		cursor += 1000
-		rows.Close()
+	user := app.getUser(w, r, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
+	memo, err := app.Memos.Memo(memoId)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if memo == nil || memo.User != user.Id {
+		notFound(w)
+		return
+	}
+	memo.Username = app.getUserName(memo.User)
 
-	return nil
-}
-
-func mdCacheKye(md string) string {
-	h := md5.New()
-	io.WriteString(h, md)
-	return string(h.Sum(nil))
+	v := &View{
+		User:    user,
+		Memo:    memo,
+		Session: session,
+	}
+	if err = app.render(w, r, "memo_edit", v); err != nil {
+		serverError(w, err)
+	}
 }
 
-func cacheHTML(md string) {
-	out := blackfriday.MarkdownCommon([]byte(md))
-	gocache.Set(mdCacheKye(md), template.HTML(out), 10000*time.Second)
-}
+func (app *App) memoUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if antiCSRF(w, r, session) {
+		return
+	}
+	vars := mux.Vars(r)
+	memoId, _ := strconv.Atoi(vars["memo_id"])
 
-func getHTML(md string) (template.HTML, bool) {
-	cache, found := gocache.Get(mdCacheKye(md))
-	if !found {
-		log.Printf("HTML cache not found")
-		return "", false
+	user := app.getUser(w, r, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	memo, err := app.Memos.Memo(memoId)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if memo == nil || memo.User != user.Id {
+		notFound(w)
+		return
+	}
+	var isPrivate int
+	if r.FormValue("is_private") == "1" {
+		isPrivate = 1
+	}
+	old := *memo
+	memo.Content = r.FormValue("content")
+	memo.IsPrivate = isPrivate
+	memo.Tags = memoTags(memo.Content, r.FormValue("tags"))
+	if err = app.Memos.UpdateMemo(memo); err != nil {
+		serverError(w, err)
+		return
+	}
+	if err = app.Index.Update(&old, memo); err != nil {
+		// the edit is saved; only listings lag until the next /init
+		logError(w, fmt.Errorf("memo %d: %s", memo.Id, err))
 	}
-	return cache.(template.HTML), true
+	if isPrivate == 1 && old.IsPrivate == 0 {
+		app.cache.Decrement("public_memo_count", 1)
+	} else if isPrivate == 0 && old.IsPrivate == 1 {
+		app.cache.Increment("public_memo_count", 1)
+	}
+	app.cacheHTML(requestID(w), memo.Content)
+	http.Redirect(w, r, fmt.Sprintf("/memo/%d", memo.Id), http.StatusFound)
 }
 
-func lookupMemoMulti(dbConn *sql.DB, memoIds []string) (Memos, error) {
-	memos := make(Memos, 0)
-	placeHolder := "0"
-	args := []interface{}{}
-	for _, id := range memoIds {
-		placeHolder += "," + id
-		args = append(args, id)
+func (app *App) publicMemoCount() (int, error) {
+	x, found := app.cache.Get("public_memo_count")
+	app.metrics.countCacheLookup("public_memo_count", found)
+	if found {
+		return x.(int), nil
 	}
-	rows, err := dbConn.Query("SELECT * FROM memos WHERE id IN (" + placeHolder + ")")
-	defer rows.Close()
+	totalCount, err := app.Index.PublicMemoCount()
 	if err != nil {
-		return memos, err
+		return 0, err
 	}
+	app.cache.Set("public_memo_count", totalCount, 30*time.Second)
+	return totalCount, nil
+}
 
-	memberOf := make(map[string]Memo, 1000)
-	for rows.Next() {
-		memo := Memo{}
-		rows.Scan(&memo.Id, &memo.User, &memo.Content, &memo.IsPrivate, &memo.CreatedAt, &memo.UpdatedAt)
-		memo.Username = getUserName(memo.User)
-		memos = append(memos, &memo)
-		memberOf[fmt.Sprintf("%d", memo.Id)] = memo
+// rebuildIndex empties the index and adds every memo back, warming the
+// Markdown cache on the way; the warm-up logs against request reqID.
+func (app *App) rebuildIndex(reqID string) error {
+	if err := app.Index.Reset(); err != nil {
+		return err
 	}
-
-	results := make(Memos, 0)
-	for _, id := range memoIds {
-		if v, found := memberOf[id]; found {
-			results = append(results, &v)
+	var mds []string
+	err := app.Memos.Scan(2000, func(memos Memos) error {
+		for _, m := range memos {
+			mds = append(mds, m.Content)
 		}
+		return app.Index.Add(memos...)
+	})
+	if err != nil {
+		return err
 	}
-	return results, nil
+	// Warm the render cache behind /init rather than during it.
+	go func() {
+		warm := app.warmRenders(reqID)
+		defer close(warm)
+		for _, md := range mds {
+			warm <- md
+		}
+	}()
+	return app.Index.MarkMigrated()
 }
 
-func lookupUserNameMulti(dbConn *sql.DB, userIds []int) (map[int]string, error) {
+func firstLine(s string) string {
+	sl := strings.Split(s, "\n")
+	return sl[0]
+}
 
-	usernameOf := map[int]string{}
-	placeHolder := "0"
-	args := []interface{}{}
-	for _, id := range userIds {
-		placeHolder += fmt.Sprintf(",%d", id)
-		args = append(args, id)
+func (app *App) genMarkdown(reqID, md string) template.HTML {
+	h, found := app.getHTML(reqID, md)
+	if found {
+		return h
 	}
-	rows, err := dbConn.Query("SELECT id, username FROM users WHERE id IN (" + placeHolder + ")")
+	return app.cacheHTML(reqID, md)
+}
+
+// renderMarkdown is the one place memo HTML is made, so neither pages nor
+// the cache ever see it unsanitised.
+func (app *App) renderMarkdown(md string) template.HTML {
+	out := app.Renderer.render([]byte(md))
+	return template.HTML(app.Sanitizer.sanitize(out))
+}
+
+// lookupMemoMulti returns the memos with memoIds in that order, with
+// their usernames.
+func (app *App) lookupMemoMulti(memoIds []int) (Memos, error) {
+	memos, err := app.Memos.Memos(memoIds)
 	if err != nil {
-		return usernameOf, err
+		return nil, err
 	}
-	for rows.Next() {
-		username := ""
-		id := 0
-		rows.Scan(&id, &username)
-		usernameOf[id] = username
+	for _, m := range memos {
+		m.Username = app.getUserName(m.User)
 	}
-	rows.Close()
-	return usernameOf, err
+	return memos, nil
 }
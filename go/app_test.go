@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestApp returns an App on unreachable backends; handlers that stay
+// away from MySQL, Redis and memcache work as usual.
+func newTestApp(t *testing.T, configure func(*Config)) *App {
+	t.Helper()
+	var c Config
+	c.Sessions.Secret = strings.Repeat("s", minSessionSecretLength)
+	c.PasswordHash.Algorithm = "bcrypt"
+	c.PasswordHash.BcryptCost = 4
+	c.AccessLog.Format = "off"
+	if configure != nil {
+		configure(&c)
+	}
+	c.setDefaults()
+	app, err := NewApp(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+	return app
+}
+
+// newMemoryTestApp is newTestApp on the memory storage, on which every
+// handler works.
+func newMemoryTestApp(t *testing.T, configure func(*Config)) *App {
+	t.Helper()
+	return newTestApp(t, func(c *Config) {
+		c.Storage = storageMemory
+		if configure != nil {
+			configure(c)
+		}
+	})
+}
+
+func TestTwoApps(t *testing.T) {
+	a := newTestApp(t, nil)
+	b := newTestApp(t, func(c *Config) {
+		c.Redis.Addr = "127.0.0.1:1"
+		c.Sessions.Name = "other_session"
+		c.Pagination.MemosPerPage = 10
+		c.TrustedProxies = []string{"10.0.0.0/8"}
+	})
+	if a.Redis == b.Redis || a.DB == b.DB || a.Templates == b.Templates || a.metrics == b.metrics {
+		t.Fatal("apps share backends")
+	}
+	if a.MemosPerPage != 100 || b.MemosPerPage != 10 || b.SessionName != "other_session" {
+		t.Fatalf("settings leaked: %d %d %q", a.MemosPerPage, b.MemosPerPage, b.SessionName)
+	}
+
+	a.setUserName(1, "alice")
+	if got := b.getUserName(1); got != "" {
+		t.Errorf("b sees a's user name %q", got)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "memo.example"
+	r.RemoteAddr = "10.1.2.3:4000"
+	r.Header.Set("X-Forwarded-Host", "front.example")
+	if got := a.baseURL(r); got != "http://memo.example" {
+		t.Errorf("a.baseURL = %q", got)
+	}
+	if got := b.baseURL(r); got != "http://front.example" {
+		t.Errorf("b.baseURL = %q", got)
+	}
+
+	var out bytes.Buffer
+	if err := b.Templates.ExecuteTemplate(&out, "signup", &View{BaseURL: b.baseURL(r)}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `action="http://front.example/signup"`) {
+		t.Errorf("signup form does not use the request's base URL:\n%s", out.String())
+	}
+}
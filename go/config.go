@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The config file is given with -config or ISUCON_CONFIG. Some of its
+// values, the ones applyEnv lists, can then be overridden from the
+// environment, which is where secrets such as the session secret belong.
+
+var configPath = flag.String("config", os.Getenv("ISUCON_CONFIG"), "path to the JSON config file (default $ISUCON_CONFIG)")
+
+type Config struct {
+	// Storage is "mysql", which also needs Redis and memcache, or
+	// "memory", which needs nothing and forgets everything on exit.
+	Storage  string         `json:"storage"`
+	Database DatabaseConfig `json:"database"`
+	Redis    RedisConfig    `json:"redis"`
+	Memcache struct {
+		Addr string `json:"addr"`
+	} `json:"memcache"`
+	Sessions struct {
+		Name   string `json:"name"`
+		Secret string `json:"secret"`
+	} `json:"sessions"`
+	Server struct {
+		// Listen is "unix:/path/to.sock" or a TCP "host:port".
+		Listen string `json:"listen"`
+		// ShutdownTimeoutSeconds bounds how long in-flight requests may
+		// run after SIGTERM, SIGINT or SIGUSR2.
+		ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+		// AdminListen is a TCP "host:port" for /metrics and /debug/*.
+		// When empty they are served on Listen to loopback clients only.
+		AdminListen string `json:"admin_listen"`
+	} `json:"server"`
+	Pagination struct {
+		MemosPerPage int `json:"memos_per_page"`
+	} `json:"pagination"`
+	Trash struct {
+		RetentionDays int `json:"retention_days"`
+	} `json:"trash"`
+	PasswordPolicy PasswordPolicy     `json:"password_policy"`
+	PasswordHash   PasswordHashConfig `json:"password_hash"`
+	LoginThrottle  LoginThrottle      `json:"login_throttle"`
+	TrustedProxies []string           `json:"trusted_proxies"`
+	AccessLog      AccessLogConfig    `json:"access_log"`
+	Markdown       MarkdownConfig     `json:"markdown"`
+	Sanitize       SanitizeConfig     `json:"sanitize"`
+	RenderCache    RenderCacheConfig  `json:"render_cache"`
+}
+
+const minSessionSecretLength = 32
+
+const (
+	storageMySQL  = "mysql"
+	storageMemory = "memory"
+)
+
+func loadConfig(filename string) (*Config, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("config: no config file; pass -config or set ISUCON_CONFIG")
+	}
+	log.Printf("loading config file: %s", filename)
+	f, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+	var config Config
+	if err = json.Unmarshal(f, &config); err != nil {
+		return nil, fmt.Errorf("config: %s: %s", filename, err)
+	}
+	if err = config.applyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	config.setDefaults()
+	if err = config.validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// applyEnv overrides the config values below with the ISUCON_* environment
+// variables that are set. Any other value comes from the file or its
+// default only.
+func (c *Config) applyEnv(getenv func(string) string) error {
+	strs := map[string]*string{
+		"ISUCON_STORAGE":        &c.Storage,
+		"ISUCON_DB_HOST":        &c.Database.Host,
+		"ISUCON_DB_NAME":        &c.Database.Dbname,
+		"ISUCON_DB_USER":        &c.Database.Username,
+		"ISUCON_DB_PASSWORD":    &c.Database.Password,
+		"ISUCON_REDIS_ADDR":     &c.Redis.Addr,
+		"ISUCON_MEMCACHE_ADDR":  &c.Memcache.Addr,
+		"ISUCON_SESSION_NAME":   &c.Sessions.Name,
+		"ISUCON_SESSION_SECRET": &c.Sessions.Secret,
+		"ISUCON_LISTEN":         &c.Server.Listen,
+		"ISUCON_ADMIN_LISTEN":   &c.Server.AdminListen,
+	}
+	ints := map[string]*int{
+		"ISUCON_DB_PORT":        &c.Database.Port,
+		"ISUCON_DB_MAX_OPEN":    &c.Database.MaxOpenConns,
+		"ISUCON_DB_MAX_IDLE":    &c.Database.MaxIdleConns,
+		"ISUCON_MEMOS_PER_PAGE": &c.Pagination.MemosPerPage,
+	}
+	for name, p := range strs {
+		if v := getenv(name); v != "" {
+			*p = v
+		}
+	}
+	for name, p := range ints {
+		v := getenv(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: %s: %q is not a number", name, v)
+		}
+		*p = n
+	}
+	return nil
+}
+
+func (c *Config) setDefaults() {
+	if c.Storage == "" {
+		c.Storage = storageMySQL
+	}
+	c.Database = c.Database.withDefaults()
+	c.Redis = c.Redis.withDefaults()
+	if c.Memcache.Addr == "" {
+		c.Memcache.Addr = "localhost:11212"
+	}
+	if c.Sessions.Name == "" {
+		c.Sessions.Name = "isucon_session"
+	}
+	if c.Server.Listen == "" {
+		c.Server.Listen = "unix:/tmp/server.sock"
+	}
+	if c.Server.ShutdownTimeoutSeconds <= 0 {
+		c.Server.ShutdownTimeoutSeconds = 30
+	}
+	if c.Pagination.MemosPerPage == 0 {
+		c.Pagination.MemosPerPage = 100
+	}
+}
+
+func (c *Config) validate() error {
+	var errs []string
+	switch c.Storage {
+	case storageMySQL:
+		if c.Database.Dbname == "" {
+			errs = append(errs, "database.dbname is required")
+		}
+		if c.Database.Username == "" {
+			errs = append(errs, "database.username is required")
+		}
+		if c.Database.Port <= 0 || c.Database.Port > 65535 {
+			errs = append(errs, fmt.Sprintf("database.port %d is out of range", c.Database.Port))
+		}
+		if c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+			errs = append(errs, "database.max_idle_conns must not exceed database.max_open_conns")
+		}
+	case storageMemory:
+		if c.RenderCache.Shared != "" {
+			errs = append(errs, "render_cache.shared needs the mysql storage")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("storage %q is neither %q nor %q", c.Storage, storageMySQL, storageMemory))
+	}
+	if c.Sessions.Secret == "" {
+		errs = append(errs, "sessions.secret is required; set ISUCON_SESSION_SECRET")
+	} else if len(c.Sessions.Secret) < minSessionSecretLength {
+		errs = append(errs, fmt.Sprintf("sessions.secret must be at least %d bytes", minSessionSecretLength))
+	}
+	if c.Pagination.MemosPerPage <= 0 {
+		errs = append(errs, "pagination.memos_per_page must be positive")
+	}
+	switch c.RenderCache.Shared {
+	case "", renderCacheRedis, renderCacheMemcache:
+	default:
+		errs = append(errs, fmt.Sprintf("render_cache.shared %q is neither %q nor %q", c.RenderCache.Shared, renderCacheRedis, renderCacheMemcache))
+	}
+	if _, _, err := c.listenAddr(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// listenAddr splits server.listen into a net.Listen network and address.
+func (c *Config) listenAddr() (network, addr string, err error) {
+	if strings.HasPrefix(c.Server.Listen, "unix:") {
+		addr = strings.TrimPrefix(c.Server.Listen, "unix:")
+		if addr == "" {
+			return "", "", fmt.Errorf("server.listen %q has no socket path", c.Server.Listen)
+		}
+		return "unix", addr, nil
+	}
+	if !strings.Contains(c.Server.Listen, ":") {
+		return "", "", fmt.Errorf("server.listen %q is neither unix:/path nor host:port", c.Server.Listen)
+	}
+	return "tcp", c.Server.Listen, nil
+}
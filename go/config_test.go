@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigApplyEnv(t *testing.T) {
+	var c Config
+	c.Database.Host = "db.example"
+	env := map[string]string{
+		"ISUCON_DB_PORT":        "3307",
+		"ISUCON_SESSION_SECRET": "s3cret",
+		"ISUCON_LISTEN":         ":5000",
+	}
+	if err := c.applyEnv(func(k string) string { return env[k] }); err != nil {
+		t.Fatal(err)
+	}
+	if c.Database.Host != "db.example" || c.Database.Port != 3307 || c.Sessions.Secret != "s3cret" || c.Server.Listen != ":5000" {
+		t.Fatalf("applyEnv: %+v", c)
+	}
+
+	env["ISUCON_DB_PORT"] = "many"
+	if err := c.applyEnv(func(k string) string { return env[k] }); err == nil || !strings.Contains(err.Error(), "ISUCON_DB_PORT") {
+		t.Fatalf("applyEnv with a bad number: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	var c Config
+	c.setDefaults()
+	err := c.validate()
+	if err == nil {
+		t.Fatal("empty config validated")
+	}
+	for _, want := range []string{"database.dbname", "database.username", "ISUCON_SESSION_SECRET"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validate error %q does not mention %s", err, want)
+		}
+	}
+
+	c.Database.Dbname = "isucon"
+	c.Database.Username = "isucon"
+	c.Sessions.Secret = strings.Repeat("x", minSessionSecretLength)
+	if err := c.validate(); err != nil {
+		t.Fatalf("validate: %s", err)
+	}
+	c.Server.Listen = "nowhere"
+	if err := c.validate(); err == nil {
+		t.Fatal("bad server.listen validated")
+	}
+}
+
+func TestConfigValidateMemoryStorage(t *testing.T) {
+	var c Config
+	c.Storage = storageMemory
+	c.Sessions.Secret = strings.Repeat("x", minSessionSecretLength)
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		t.Fatalf("memory storage needs no database: %s", err)
+	}
+	c.RenderCache.Shared = renderCacheRedis
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "render_cache.shared") {
+		t.Fatalf("shared render cache on memory storage: %v", err)
+	}
+	c.RenderCache.Shared = ""
+	c.Storage = "sqlite"
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "storage") {
+		t.Fatalf("unknown storage: %v", err)
+	}
+}
+
+func TestConfigListenAddr(t *testing.T) {
+	tests := map[string][2]string{
+		"unix:/tmp/server.sock": {"unix", "/tmp/server.sock"},
+		":5000":                 {"tcp", ":5000"},
+		"127.0.0.1:8080":        {"tcp", "127.0.0.1:8080"},
+	}
+	for listen, want := range tests {
+		var c Config
+		c.Server.Listen = listen
+		network, addr, err := c.listenAddr()
+		if err != nil || network != want[0] || addr != want[1] {
+			t.Errorf("listenAddr(%q) = %s, %s, %v", listen, network, addr, err)
+		}
+	}
+}
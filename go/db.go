@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// DatabaseConfig is the database section of the config file.
+type DatabaseConfig struct {
+	Dbname                 string `json:"dbname"`
+	Host                   string `json:"host"`
+	Port                   int    `json:"port"`
+	Username               string `json:"username"`
+	Password               string `json:"password"`
+	MaxOpenConns           int    `json:"max_open_conns"`
+	MaxIdleConns           int    `json:"max_idle_conns"`
+	ConnMaxLifetimeSeconds int    `json:"conn_max_lifetime_seconds"`
+}
+
+func (c DatabaseConfig) withDefaults() DatabaseConfig {
+	if c.Host == "" {
+		c.Host = "localhost"
+	}
+	if c.Port == 0 {
+		c.Port = 3306
+	}
+	if c.MaxOpenConns <= 0 {
+		c.MaxOpenConns = 10
+	}
+	if c.MaxIdleConns <= 0 {
+		c.MaxIdleConns = c.MaxOpenConns
+	}
+	if c.ConnMaxLifetimeSeconds <= 0 {
+		c.ConnMaxLifetimeSeconds = 300
+	}
+	return c
+}
+
+// openDB opens the one *sql.DB shared by every handler; database/sql does
+// the pooling.
+func openDB(dsn string, c DatabaseConfig) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(c.ConnMaxLifetimeSeconds) * time.Second)
+	return db, nil
+}
+
+// dbStatsHandler serves app.DB.Stats() as JSON.
+func (app *App) dbStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := app.DB.Stats()
+	debugJSON(w, map[string]interface{}{
+		"max_open_connections": stats.MaxOpenConnections,
+		"open_connections":     stats.OpenConnections,
+		"in_use":               stats.InUse,
+		"idle":                 stats.Idle,
+		"wait_count":           stats.WaitCount,
+		"wait_duration_ms":     stats.WaitDuration.Nanoseconds() / int64(time.Millisecond),
+		"max_idle_closed":      stats.MaxIdleClosed,
+		"max_lifetime_closed":  stats.MaxLifetimeClosed,
+	})
+}
+
+func debugJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		serverError(w, err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	feedEntries  = 30
+	dbTimeLayout = "2006-01-02 15:04:05"
+)
+
+type atomFeed struct {
+	XMLName xml.Name     `xml:"feed"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Title   string       `xml:"title"`
+	Id      string       `xml:"id"`
+	Updated string       `xml:"updated"`
+	Links   []atomLink   `xml:"link"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	Id        string      `xml:"id"`
+	Links     []atomLink  `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    atomPerson  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	LastBuildDate string     `xml:"lastBuildDate,omitempty"`
+	Items         []*rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Guid        rssGuid `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// parseDBTime parses a DATETIME/TIMESTAMP column as returned by the
+// driver without parseTime.
+func parseDBTime(s string) time.Time {
+	t, err := time.ParseInLocation(dbTimeLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func memoURL(base string, memo *Memo) string {
+	return fmt.Sprintf("%s/memo/%d", base, memo.Id)
+}
+
+// feedMemos returns the public memos among memoIds, as read from one of
+// the index's newest-first lists, and the latest UpdatedAt among them.
+func (app *App) feedMemos(memoIds []int, err error) (Memos, time.Time, error) {
+	var updated time.Time
+	if err != nil {
+		return nil, updated, err
+	}
+	memos, err := app.lookupMemoMulti(memoIds)
+	if err != nil {
+		return nil, updated, err
+	}
+	public := make(Memos, 0, len(memos))
+	for _, m := range memos {
+		if m.IsPrivate != 0 {
+			continue
+		}
+		if t := parseDBTime(m.UpdatedAt); t.After(updated) {
+			updated = t
+		}
+		public = append(public, m)
+	}
+	return public, updated, nil
+}
+
+// feedUpdated is the modification time of a feed whose memos were last
+// updated at updated: the later of that and modified, the index's
+// PublicUpdated or UserPublicUpdated, which also moves when a memo leaves
+// the feed. A feed with neither is as of the epoch, so that it stays the
+// same between requests and conditional GETs still match.
+func feedUpdated(updated, modified time.Time) time.Time {
+	if modified.After(updated) {
+		updated = modified
+	}
+	if updated.IsZero() {
+		updated = time.Unix(0, 0).UTC()
+	}
+	return updated
+}
+
+func (app *App) newAtomFeed(reqID, base, title, selfPath, alternatePath string, memos Memos, updated time.Time) *atomFeed {
+	feed := &atomFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		Title:   title,
+		Id:      base + selfPath,
+		Updated: updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + selfPath},
+			{Rel: "alternate", Type: "text/html", Href: base + alternatePath},
+		},
+	}
+	for _, m := range memos {
+		link := memoURL(base, m)
+		feed.Entries = append(feed.Entries, &atomEntry{
+			Title:     firstLine(m.Content),
+			Id:        link,
+			Links:     []atomLink{{Rel: "alternate", Type: "text/html", Href: link}},
+			Published: parseDBTime(m.CreatedAt).Format(time.RFC3339),
+			Updated:   parseDBTime(m.UpdatedAt).Format(time.RFC3339),
+			Author:    atomPerson{Name: m.Username},
+			Content:   atomContent{Type: "html", Body: string(app.genMarkdown(reqID, m.Content))},
+		})
+	}
+	return feed
+}
+
+// serveFeed writes v as XML. http.ServeContent answers If-Modified-Since
+// and If-None-Match against updated and the ETag.
+func serveFeed(w http.ResponseWriter, r *http.Request, contentType string, v interface{}, updated time.Time) {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	body := append([]byte(xml.Header), out...)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	http.ServeContent(w, r, "", updated, bytes.NewReader(body))
+}
+
+func (app *App) recentAtomHandler(w http.ResponseWriter, r *http.Request) {
+	base := app.baseURL(r)
+	// before the list, so a change in between is seen next time
+	modified, err := app.Index.PublicUpdated()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	memos, updated, err := app.feedMemos(app.Index.PublicMemos(0, feedEntries))
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	updated = feedUpdated(updated, modified)
+	feed := app.newAtomFeed(requestID(w), base, "Isucon3 recent memos", "/recent.atom", "/", memos, updated)
+	serveFeed(w, r, "application/atom+xml; charset=utf-8", feed, updated)
+}
+
+func (app *App) recentRSSHandler(w http.ResponseWriter, r *http.Request) {
+	base := app.baseURL(r)
+	modified, err := app.Index.PublicUpdated()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	memos, updated, err := app.feedMemos(app.Index.PublicMemos(0, feedEntries))
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	updated = feedUpdated(updated, modified)
+	feed := &rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         "Isucon3 recent memos",
+			Link:          base + "/",
+			Description:   "Recent public memos",
+			LastBuildDate: updated.Format(time.RFC1123Z),
+		},
+	}
+	for _, m := range memos {
+		link := memoURL(base, m)
+		feed.Channel.Items = append(feed.Channel.Items, &rssItem{
+			Title:       firstLine(m.Content),
+			Link:        link,
+			Guid:        rssGuid{IsPermaLink: true, Value: link},
+			PubDate:     parseDBTime(m.CreatedAt).Format(time.RFC1123Z),
+			Description: string(app.genMarkdown(requestID(w), m.Content)),
+		})
+	}
+	serveFeed(w, r, "application/rss+xml; charset=utf-8", feed, updated)
+}
+
+func (app *App) userAtomHandler(w http.ResponseWriter, r *http.Request) {
+	base := app.baseURL(r)
+	vars := mux.Vars(r)
+	username := vars["username"]
+
+	user, err := app.Users.UserByName(username)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		notFound(w)
+		return
+	}
+
+	modified, err := app.Index.UserPublicUpdated(user.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	memos, updated, err := app.feedMemos(app.Index.UserPublicMemos(user.Id, 0, feedEntries))
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	updated = feedUpdated(updated, modified)
+	feed := app.newAtomFeed(requestID(w), base,
+		fmt.Sprintf("Isucon3 memos by %s", username),
+		fmt.Sprintf("/user/%s.atom", url.PathEscape(username)), "/",
+		memos, updated,
+	)
+	serveFeed(w, r, "application/atom+xml; charset=utf-8", feed, updated)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The listening socket comes from, in order of preference:
+//
+//   - systemd socket activation (LISTEN_PID/LISTEN_FDS), or
+//   - the parent process on a SIGUSR2 restart (ISUCON_LISTEN_FD), or
+//   - a fresh net.Listen on server.listen or -port.
+//
+// SIGUSR2 starts a copy of the running binary with the socket as fd 3 and
+// the write end of a pipe as fd 4. The copy writes a byte to the pipe once
+// it has loaded its config and is serving, and only then is this process
+// drained like SIGTERM drains it, so a deploy can replace the binary and
+// signal the old process without refusing any connections. If the copy
+// exits or stays silent for restartTimeout, it is killed and this process
+// keeps serving.
+
+const (
+	// listenFdsStart is SD_LISTEN_FDS_START, the first inherited fd.
+	listenFdsStart = 3
+	listenFDEnv    = "ISUCON_LISTEN_FD"
+	readyFDEnv     = "ISUCON_READY_FD"
+	restartTimeout = 30 * time.Second
+)
+
+// inheritedFD returns the fd of a listening socket passed down by systemd
+// or by a restarting parent, if any.
+func inheritedFD(getenv func(string) string, pid int) (int, bool, error) {
+	if fds := getenv("LISTEN_FDS"); fds != "" {
+		if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+			return 0, false, nil
+		}
+		n, err := strconv.Atoi(fds)
+		if err != nil || n < 1 {
+			return 0, false, fmt.Errorf("LISTEN_FDS: invalid value %q", fds)
+		}
+		if n > 1 {
+			log.Printf("LISTEN_FDS=%d: only the first socket is used", n)
+		}
+		return listenFdsStart, true, nil
+	}
+	if v := getenv(listenFDEnv); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil || fd < listenFdsStart {
+			return 0, false, fmt.Errorf("%s: invalid value %q", listenFDEnv, v)
+		}
+		return fd, true, nil
+	}
+	return 0, false, nil
+}
+
+// listen returns the listener to serve on, inheriting one when possible.
+func listen(network, addr string) (net.Listener, error) {
+	fd, ok, err := inheritedFD(os.Getenv, os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", listenFDEnv} {
+		os.Unsetenv(name)
+	}
+	if ok {
+		f := os.NewFile(uintptr(fd), "listener")
+		defer f.Close()
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %d: %s", fd, err)
+		}
+		log.Printf("listening on inherited %s", l.Addr())
+		return l, nil
+	}
+
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+	// Only remove the socket file when nothing answers on it, so starting
+	// a second copy by mistake cannot steal the socket from a live one.
+	if c, err := net.DialTimeout("unix", addr, time.Second); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s is in use by another process", addr)
+	}
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(addr, 0777)
+	return l, nil
+}
+
+// restart starts a new copy of this binary that inherits l and returns
+// once it is serving. On an error the copy, if any, has been stopped.
+func restart(l net.Listener) error {
+	var f *os.File
+	var err error
+	switch l := l.(type) {
+	case *net.UnixListener:
+		// The socket file now belongs to the new process, unless it fails.
+		l.SetUnlinkOnClose(false)
+		defer func() {
+			if err != nil {
+				l.SetUnlinkOnClose(true)
+			}
+		}()
+		f, err = l.File()
+	case *net.TCPListener:
+		f, err = l.File()
+	default:
+		return fmt.Errorf("cannot pass on a %T", l)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	ready, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Dir: wd,
+		Env: append(os.Environ(),
+			fmt.Sprintf("%s=%d", listenFDEnv, listenFdsStart),
+			fmt.Sprintf("%s=%d", readyFDEnv, listenFdsStart+1)),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, f, w},
+	})
+	// Only the new process may hold the write end, so that its exit is
+	// seen as EOF.
+	w.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("restart: started pid %d", p.Pid)
+	if err = waitReady(ready, restartTimeout); err != nil {
+		p.Kill()
+		p.Wait()
+		return fmt.Errorf("pid %d: %s", p.Pid, err)
+	}
+	log.Printf("restart: pid %d is serving", p.Pid)
+	return p.Release()
+}
+
+// waitReady waits up to timeout for a byte on ready.
+func waitReady(ready *os.File, timeout time.Duration) error {
+	if err := ready.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	n, err := ready.Read(make([]byte, 1))
+	switch {
+	case n == 1:
+		return nil
+	case err == io.EOF:
+		return errors.New("exited before it was ready")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Errorf("not ready after %s", timeout)
+	}
+	return err
+}
+
+// signalReady tells the parent of a SIGUSR2 restart, if any, that this
+// process is serving.
+func signalReady() {
+	v := os.Getenv(readyFDEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < listenFdsStart {
+		log.Printf("error: %s: invalid value %q", readyFDEnv, v)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("error: restart: %s", err)
+	}
+}
+
+// serve runs srv on l until SIGTERM, SIGINT or SIGUSR2, then lets in-flight
+// requests finish for up to drain. The admin server, if any, is closed
+// straight away so that a restarted process can bind its address.
+func (app *App) serve(srv *http.Server, l net.Listener, drain time.Duration, admin *http.Server) error {
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+	signalReady()
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case sig := <-sigchan:
+			if sig == syscall.SIGUSR2 {
+				if err := restart(l); err != nil {
+					log.Printf("error: restart: %s", err)
+					continue
+				}
+			}
+			atomic.StoreInt32(&app.draining, 1)
+			if admin != nil {
+				admin.Close()
+			}
+			log.Printf("%s: draining for up to %s", sig, drain)
+			ctx, cancel := context.WithTimeout(context.Background(), drain)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+// serveAdmin runs the admin server on addr. During a SIGUSR2 restart the
+// old process may still hold addr for a moment, so binding is retried.
+func serveAdmin(srv *http.Server, addr string) {
+	var l net.Listener
+	var err error
+	for i := 0; i < 50; i++ {
+		if l, err = net.Listen("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		log.Printf("error: admin listener: %s", err)
+		return
+	}
+	log.Printf("admin endpoints on %s", l.Addr())
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		log.Printf("error: admin listener: %s", err)
+	}
+}
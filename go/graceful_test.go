@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInheritedFD(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		fd   int
+		ok   bool
+		fail bool
+	}{
+		{env: map[string]string{}},
+		{env: map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"}, fd: 3, ok: true},
+		{env: map[string]string{"LISTEN_PID": "41", "LISTEN_FDS": "1"}},
+		{env: map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "0"}, fail: true},
+		{env: map[string]string{"ISUCON_LISTEN_FD": "3"}, fd: 3, ok: true},
+		{env: map[string]string{"ISUCON_LISTEN_FD": "1"}, fail: true},
+	}
+	for _, tt := range tests {
+		fd, ok, err := inheritedFD(func(k string) string { return tt.env[k] }, 42)
+		if (err != nil) != tt.fail || ok != tt.ok || fd != tt.fd {
+			t.Errorf("inheritedFD(%v) = %d, %v, %v", tt.env, fd, ok, err)
+		}
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	pipe := func() (*os.File, *os.File) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close(); w.Close() })
+		return r, w
+	}
+
+	// signalReady writes to the fd named in the environment, as a
+	// restarted process does.
+	r, w := pipe()
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(readyFDEnv, strconv.Itoa(fd))
+	signalReady()
+	if err := waitReady(r, time.Second); err != nil {
+		t.Errorf("after signalReady: %v", err)
+	}
+	if v := os.Getenv(readyFDEnv); v != "" {
+		t.Errorf("%s still set to %q", readyFDEnv, v)
+	}
+
+	r, w = pipe()
+	w.Close()
+	if err := waitReady(r, time.Second); err == nil {
+		t.Error("a process that exited counted as ready")
+	}
+
+	r, _ = pipe()
+	start := time.Now()
+	if err := waitReady(r, 50*time.Millisecond); err == nil {
+		t.Error("a silent process counted as ready")
+	} else if time.Since(start) > time.Second {
+		t.Errorf("waitReady took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The handler tests run the whole Router over a real listener against the
+// memory storage, one testClient (with its own cookie jar) per browser.
+
+type testClient struct {
+	t      *testing.T
+	base   string
+	client *http.Client
+	header http.Header
+}
+
+type testResponse struct {
+	code     int
+	location string
+	body     string
+}
+
+func newTestServer(t *testing.T, configure func(*Config)) (*App, *httptest.Server) {
+	t.Helper()
+	app := newMemoryTestApp(t, configure)
+	if err := app.initNames(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(app.Router(false))
+	t.Cleanup(srv.Close)
+	return app, srv
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server) *testClient {
+	jar, _ := cookiejar.New(nil)
+	return &testClient{
+		t:    t,
+		base: srv.URL,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		header: make(http.Header),
+	}
+}
+
+func (c *testClient) do(req *http.Request) *testResponse {
+	c.t.Helper()
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return &testResponse{resp.StatusCode, resp.Header.Get("Location"), string(body)}
+}
+
+func (c *testClient) get(path string) *testResponse {
+	c.t.Helper()
+	req, _ := http.NewRequest("GET", c.base+path, nil)
+	return c.do(req)
+}
+
+func (c *testClient) post(path string, form url.Values) *testResponse {
+	c.t.Helper()
+	req, _ := http.NewRequest("POST", c.base+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+func (c *testClient) postJSON(path string, v interface{}) *testResponse {
+	c.t.Helper()
+	b, _ := json.Marshal(v)
+	req, _ := http.NewRequest("POST", c.base+path, strings.NewReader(string(b)))
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req)
+}
+
+const testPassword = "correct9horse"
+
+// signUp creates username and leaves c signed in as it.
+func (c *testClient) signUp(username string) {
+	c.t.Helper()
+	res := c.postSignup(username, testPassword)
+	if res.code != http.StatusFound || res.location != "/mypage" {
+		c.t.Fatalf("signup %s = %d %s\n%s", username, res.code, res.location, res.body)
+	}
+}
+
+// postSignup submits the signup form as loaded by c.
+func (c *testClient) postSignup(username, password string) *testResponse {
+	c.t.Helper()
+	m := sidRegexp.FindStringSubmatch(c.get("/signup").body)
+	if m == nil {
+		c.t.Fatal("no sid on the signup form")
+	}
+	return c.post("/signup", url.Values{
+		"sid":              {m[1]},
+		"username":         {username},
+		"password":         {password},
+		"password_confirm": {password},
+	})
+}
+
+var sidRegexp = regexp.MustCompile(`name="sid" value="([0-9a-f]+)"`)
+
+// sid returns the CSRF token of c's session, as embedded in mypage.
+func (c *testClient) sid() string {
+	c.t.Helper()
+	m := sidRegexp.FindStringSubmatch(c.get("/mypage").body)
+	if m == nil {
+		c.t.Fatal("no sid on mypage; not signed in?")
+	}
+	return m[1]
+}
+
+// postMemo posts a memo through the form and returns its id.
+func (c *testClient) postMemo(content string, private bool) int {
+	c.t.Helper()
+	form := url.Values{"sid": {c.sid()}, "content": {content}}
+	if private {
+		form.Set("is_private", "1")
+	}
+	res := c.post("/memo", form)
+	if res.code != http.StatusFound || !strings.HasPrefix(res.location, "/memo/") {
+		c.t.Fatalf("post memo = %d %s\n%s", res.code, res.location, res.body)
+	}
+	id, _ := strconv.Atoi(strings.TrimPrefix(res.location, "/memo/"))
+	return id
+}
+
+var memoLinkRegexp = regexp.MustCompile(`/memo/(\d+)"`)
+
+// memoLinks returns the memo ids linked from the list with the given id
+// attribute, in page order.
+func memoLinks(body, listId string) []int {
+	start := strings.Index(body, `<ul id="`+listId+`">`)
+	if start < 0 {
+		return nil
+	}
+	body = body[start:]
+	body = body[:strings.Index(body, "</ul>")]
+	ids := make([]int, 0)
+	for _, m := range memoLinkRegexp.FindAllStringSubmatch(body, -1) {
+		id, _ := strconv.Atoi(m[1])
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func checkIds(t *testing.T, name string, got []int, want ...int) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s = %v, want %v", name, got, want)
+	}
+}
+
+func TestTopAndRecentPagination(t *testing.T) {
+	app, srv := newTestServer(t, func(c *Config) { c.Pagination.MemosPerPage = 2 })
+	alice := newTestClient(t, srv)
+	alice.signUp("alice")
+	for i := 1; i <= 6; i++ {
+		alice.postMemo(fmt.Sprintf("memo %d", i), i == 3)
+	}
+
+	anon := newTestClient(t, srv)
+	res := anon.get("/")
+	if res.code != http.StatusOK || !strings.Contains(res.body, `<span id="total">5</span>`) {
+		t.Fatalf("top = %d\n%s", res.code, res.body)
+	}
+	checkIds(t, "top", memoLinks(res.body, "memos"), 6, 5)
+	checkIds(t, "recent/1", memoLinks(anon.get("/recent/1").body, "memos"), 4, 2)
+	checkIds(t, "recent/2", memoLinks(anon.get("/recent/2").body, "memos"), 1)
+	if res := anon.get("/recent/3"); res.code != http.StatusNotFound {
+		t.Errorf("recent past the end = %d", res.code)
+	}
+
+	ids, _ := app.Index.PublicMemos(0, 100)
+	checkIds(t, "public list", ids, 6, 5, 4, 2, 1)
+	ids, _ = app.Index.UserMemos(1)
+	checkIds(t, "user list", ids, 1, 2, 3, 4, 5, 6)
+}
+
+func TestSignin(t *testing.T) {
+	app, srv := newTestServer(t, nil)
+	newTestClient(t, srv).signUp("alice")
+
+	c := newTestClient(t, srv)
+	res := c.post("/signin", url.Values{"username": {"alice"}, "password": {"wrong"}})
+	if res.code != http.StatusSeeOther || res.location != "/signin" {
+		t.Fatalf("bad password = %d %s", res.code, res.location)
+	}
+	if res := c.get("/signin"); !strings.Contains(res.body, "Wrong username or password.") {
+		t.Errorf("no flash after a failed sign-in:\n%s", res.body)
+	}
+	if res := c.get("/mypage"); res.code != http.StatusFound {
+		t.Errorf("mypage after a failed sign-in = %d", res.code)
+	}
+	if res := c.post("/signin", url.Values{"username": {"nobody"}, "password": {"x"}}); res.code != http.StatusSeeOther {
+		t.Errorf("unknown user = %d", res.code)
+	}
+
+	res = c.post("/signin", url.Values{"username": {"alice"}, "password": {testPassword}})
+	if res.code != http.StatusFound || res.location != "/mypage" {
+		t.Fatalf("good password = %d %s", res.code, res.location)
+	}
+	if res := c.get("/mypage"); res.code != http.StatusOK || !strings.Contains(res.body, "Hello alice!") {
+		t.Errorf("mypage after sign-in = %d", res.code)
+	}
+	if u, _ := app.Users.UserByName("alice"); u == nil || u.LastAccess == "" {
+		t.Errorf("last_access not set: %+v", u)
+	}
+}
+
+func TestSignupPasswordTooLongForBcrypt(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	long := strings.Repeat("パスワード1", 6) // 30 characters, 96 bytes
+	res := newTestClient(t, srv).postSignup("alice", long)
+	if res.code != http.StatusBadRequest || !strings.Contains(res.body, "at most 72 bytes") {
+		t.Fatalf("signup = %d\n%s", res.code, res.body)
+	}
+}
+
+func TestSignupRequiresCSRFToken(t *testing.T) {
+	app, srv := newTestServer(t, nil)
+	c := newTestClient(t, srv)
+	form := url.Values{"username": {"alice"}, "password": {testPassword}, "password_confirm": {testPassword}}
+	if res := c.post("/signup", form); res.code != http.StatusBadRequest {
+		t.Errorf("signup without a session = %d", res.code)
+	}
+	c.get("/signup")
+	form.Set("sid", "forged")
+	if res := c.post("/signup", form); res.code != http.StatusBadRequest {
+		t.Errorf("signup with a forged sid = %d", res.code)
+	}
+	if u, _ := app.Users.UserByName("alice"); u != nil {
+		t.Error("user created without the CSRF token")
+	}
+}
+
+func TestSignupThrottledPerIP(t *testing.T) {
+	_, srv := newTestServer(t, func(c *Config) { c.LoginThrottle.SignupsPerIP = 2 })
+	c := newTestClient(t, srv)
+	for i, want := range []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusTooManyRequests} {
+		res := c.postSignup("x", testPassword)
+		if res.code != want {
+			t.Errorf("signup %d = %d, want %d", i+1, res.code, want)
+		}
+	}
+	if res := c.postSignup("alice", testPassword); res.code != http.StatusTooManyRequests || !strings.Contains(res.body, "Too many sign-ups") {
+		t.Errorf("signup after the limit = %d\n%s", res.code, res.body)
+	}
+}
+
+func TestSignoutRequiresCSRFToken(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	c := newTestClient(t, srv)
+	c.signUp("alice")
+
+	if res := c.post("/signout", nil); res.code != http.StatusBadRequest {
+		t.Errorf("signout without sid = %d", res.code)
+	}
+	if res := c.get("/mypage"); res.code != http.StatusOK {
+		t.Fatalf("signed out without a sid: mypage = %d", res.code)
+	}
+	if res := c.post("/signout", url.Values{"sid": {c.sid()}}); res.code != http.StatusFound {
+		t.Errorf("signout = %d", res.code)
+	}
+	if res := c.get("/mypage"); res.code != http.StatusFound || res.location != "/" {
+		t.Errorf("mypage after signout = %d %s", res.code, res.location)
+	}
+}
+
+func TestMypage(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	if res := newTestClient(t, srv).get("/mypage"); res.code != http.StatusFound || res.location != "/" {
+		t.Errorf("anonymous mypage = %d %s", res.code, res.location)
+	}
+
+	c := newTestClient(t, srv)
+	c.signUp("alice")
+	c.postMemo("first #go", false)
+	c.postMemo("second", true)
+	c.postMemo("third #go", true)
+
+	res := c.get("/mypage")
+	if strings.Count(res.body, "[private]") != 2 {
+		t.Errorf("mypage does not mark the 2 private memos:\n%s", res.body)
+	}
+	if !strings.Contains(res.body, "#go</a> (2)") {
+		t.Errorf("tag cloud does not count private memos for their owner:\n%s", res.body)
+	}
+	res = c.get("/mypage?tag=go")
+	for _, want := range []string{"first", "third"} {
+		if !strings.Contains(res.body, want) {
+			t.Errorf("mypage?tag=go misses %q", want)
+		}
+	}
+	if strings.Contains(res.body, "second") {
+		t.Error("mypage?tag=go lists an untagged memo")
+	}
+}
+
+func TestMemoPost(t *testing.T) {
+	app, srv := newTestServer(t, nil)
+	if res := newTestClient(t, srv).post("/memo", url.Values{"content": {"x"}}); res.code != http.StatusBadRequest {
+		t.Errorf("anonymous post without sid = %d", res.code)
+	}
+
+	c := newTestClient(t, srv)
+	c.signUp("alice")
+	if res := c.post("/memo", url.Values{"content": {"x"}}); res.code != http.StatusBadRequest {
+		t.Errorf("post without sid = %d", res.code)
+	}
+	res := c.post("/memo", url.Values{"sid": {c.sid()}, "content": {"# Title\n\nabout #golang"}, "tags": {"perf"}})
+	if res.code != http.StatusFound || res.location != "/memo/1" {
+		t.Fatalf("post = %d %s", res.code, res.location)
+	}
+
+	memo, _ := app.Memos.Memo(1)
+	if memo == nil || memo.User != 1 || strings.Join(memo.Tags, ",") != "golang,perf" {
+		t.Fatalf("stored memo = %+v", memo)
+	}
+	ids, _ := app.Index.PublicMemos(0, 10)
+	checkIds(t, "public list", ids, 1)
+	ids, _, _ = app.Index.TagMemos("perf", 0, 10)
+	checkIds(t, "tag perf", ids, 1)
+	ids, _ = app.Index.Search(queryGrams(searchTerms("golang")))
+	checkIds(t, "search golang", ids, 1)
+
+	res = c.get("/memo/1")
+	if !strings.Contains(res.body, "<h1>Title</h1>") || !strings.Contains(res.body, `href="`+srv.URL+`/tag/perf"`) {
+		t.Errorf("memo page:\n%s", res.body)
+	}
+	if res := c.get("/tag/golang"); res.code != http.StatusOK || !strings.Contains(res.body, "memos tagged #golang") {
+		t.Errorf("tag page = %d", res.code)
+	}
+}
+
+func TestMemoPageIsSanitized(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	c := newTestClient(t, srv)
+	c.signUp("alice")
+	id := c.postMemo("hi <script>alert(1)</script> [x](javascript:alert(2)) <img src=x onerror=alert(3)>", false)
+
+	res := c.get(fmt.Sprintf("/memo/%d", id))
+	if res.code != http.StatusOK {
+		t.Fatalf("memo page = %d", res.code)
+	}
+	for _, bad := range []string{"alert(1)", "javascript:", "onerror"} {
+		if strings.Contains(res.body, bad) {
+			t.Errorf("memo page keeps %q:\n%s", bad, res.body)
+		}
+	}
+}
+
+func TestMemoEditDeleteRestorePurge(t *testing.T) {
+	app, srv := newTestServer(t, nil)
+	alice := newTestClient(t, srv)
+	alice.signUp("alice")
+	bob := newTestClient(t, srv)
+	bob.signUp("bob")
+	id := alice.postMemo("draft #go", false)
+	path := fmt.Sprintf("/memo/%d", id)
+
+	if res := bob.get(path + "/edit"); res.code != http.StatusNotFound {
+		t.Errorf("bob edits alice's memo = %d", res.code)
+	}
+	if res := bob.post(path, url.Values{"sid": {bob.sid()}, "content": {"pwned"}}); res.code != http.StatusNotFound {
+		t.Errorf("bob updates alice's memo = %d", res.code)
+	}
+	if res := alice.get(path + "/edit"); res.code != http.StatusOK || !strings.Contains(res.body, `value="go"`) {
+		t.Errorf("edit page = %d\n%s", res.code, res.body)
+	}
+
+	sid := alice.sid()
+	if res := alice.post(path, url.Values{"sid": {sid}, "content": {"final"}, "is_private": {"1"}}); res.code != http.StatusFound {
+		t.Fatalf("update = %d", res.code)
+	}
+	if ids, _ := app.Index.PublicMemos(0, 10); len(ids) != 0 {
+		t.Errorf("memo made private is still public: %v", ids)
+	}
+	if cloud, _ := app.Index.TagCloud(); len(cloud) != 0 {
+		t.Errorf("tag cloud after the tag was removed: %v", cloud)
+	}
+
+	if res := alice.post(path+"/delete", url.Values{"sid": {sid}}); res.code != http.StatusFound {
+		t.Fatalf("delete = %d", res.code)
+	}
+	if res := alice.get(path); res.code != http.StatusNotFound {
+		t.Errorf("trashed memo = %d", res.code)
+	}
+	if res := alice.get("/trash"); !strings.Contains(res.body, fmt.Sprintf("/trash/%d/restore", id)) {
+		t.Errorf("trash does not list the memo:\n%s", res.body)
+	}
+	if res := alice.post(fmt.Sprintf("/trash/%d/restore", id), url.Values{"sid": {sid}}); res.code != http.StatusFound {
+		t.Fatalf("restore = %d", res.code)
+	}
+	if res := alice.get(path); res.code != http.StatusOK || !strings.Contains(res.body, "final") {
+		t.Errorf("restored memo = %d", res.code)
+	}
+
+	alice.post(path+"/delete", url.Values{"sid": {sid}})
+	if res := bob.post(fmt.Sprintf("/trash/%d/purge", id), url.Values{"sid": {bob.sid()}}); res.code != http.StatusNotFound {
+		t.Errorf("bob purges alice's memo = %d", res.code)
+	}
+	if res := alice.post(fmt.Sprintf("/trash/%d/purge", id), url.Values{"sid": {sid}}); res.code != http.StatusFound {
+		t.Fatalf("purge = %d", res.code)
+	}
+	if res := alice.post(fmt.Sprintf("/trash/%d/restore", id), url.Values{"sid": {sid}}); res.code != http.StatusNotFound {
+		t.Errorf("restore after purge = %d", res.code)
+	}
+}
+
+// failingIndex is a MemoIndex whose changes fail after the repository has
+// saved them.
+type failingIndex struct {
+	MemoIndex
+}
+
+var errIndexDown = errors.New("index down")
+
+func (failingIndex) Update(old, memo *Memo) error { return errIndexDown }
+func (failingIndex) Remove(memo *Memo) error      { return errIndexDown }
+func (failingIndex) Restore(memo *Memo) error     { return errIndexDown }
+
+// A change the repository has saved is reported as done even when the
+// index lags behind.
+func TestMemoChangesSurviveIndexErrors(t *testing.T) {
+	app, srv := newTestServer(t, nil)
+	alice := newTestClient(t, srv)
+	alice.signUp("alice")
+	id := alice.postMemo("draft", false)
+	path := fmt.Sprintf("/memo/%d", id)
+	app.Index = failingIndex{app.Index}
+
+	sid := alice.sid()
+	if res := alice.post(path, url.Values{"sid": {sid}, "content": {"final"}}); res.code != http.StatusFound {
+		t.Errorf("update = %d", res.code)
+	}
+	if m, _ := app.Memos.Memo(id); m == nil || m.Content != "final" {
+		t.Errorf("memo after update = %+v", m)
+	}
+	if res := alice.post(path+"/delete", url.Values{"sid": {sid}}); res.code != http.StatusFound {
+		t.Errorf("delete = %d", res.code)
+	}
+	if m, _ := app.Memos.TrashedMemo(id, 1); m == nil {
+		t.Error("memo not trashed")
+	}
+	if res := alice.post(fmt.Sprintf("/trash/%d/restore", id), url.Values{"sid": {sid}}); res.code != http.StatusFound {
+		t.Errorf("restore = %d", res.code)
+	}
+	if m, _ := app.Memos.Memo(id); m == nil {
+		t.Error("memo not restored")
+	}
+}
+
+// Private memos must not show up for anyone but their owner, on any page.
+func TestPrivateMemosDoNotLeak(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	alice := newTestClient(t, srv)
+	alice.signUp("alice")
+	alice.postMemo("public one #shared", false)
+	secret := alice.postMemo("hidden-words #shared", true)
+	alice.postMemo("public two #shared", false)
+
+	bob := newTestClient(t, srv)
+	bob.signUp("bob")
+	for name, c := range map[string]*testClient{"anonymous": newTestClient(t, srv), "bob": bob} {
+		if res := c.get(fmt.Sprintf("/memo/%d", secret)); res.code != http.StatusNotFound {
+			t.Errorf("%s: private memo = %d", name, res.code)
+		}
+		if res := c.get(fmt.Sprintf("/api/v1/memos/%d", secret)); res.code != http.StatusNotFound {
+			t.Errorf("%s: private memo over the API = %d", name, res.code)
+		}
+		for _, path := range []string{
+			"/", "/recent/0", "/tag/shared", "/search?q=hidden", "/search?q=shared",
+			"/recent.atom", "/recent.rss", "/user/alice.atom",
+			"/api/v1/memos", "/api/v1/search?q=hidden",
+		} {
+			if res := c.get(path); strings.Contains(res.body, "hidden-words") {
+				t.Errorf("%s: %s shows the private memo", name, path)
+			}
+		}
+		if res := c.get("/"); !strings.Contains(res.body, "#shared</a> (2)") {
+			t.Errorf("%s: public tag cloud counts the private memo", name)
+		}
+	}
+
+	if res := alice.get(fmt.Sprintf("/memo/%d", secret)); res.code != http.StatusOK {
+		t.Errorf("owner: private memo = %d", res.code)
+	}
+	if res := alice.get("/search?q=hidden"); !strings.Contains(res.body, "hidden-words") {
+		t.Error("owner: search misses own private memo")
+	}
+}
+
+var olderNewerRegexp = regexp.MustCompile(`id="(older|newer)" href="[^"]*/memo/(\d+)"`)
+
+// olderNewer returns the ids the older and newer links of a memo page
+// point to, 0 for none.
+func olderNewer(body string) (older, newer int) {
+	for _, m := range olderNewerRegexp.FindAllStringSubmatch(body, -1) {
+		id, _ := strconv.Atoi(m[2])
+		if m[1] == "older" {
+			older = id
+		} else {
+			newer = id
+		}
+	}
+	return older, newer
+}
+
+func TestMemoOlderNewerLinks(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	alice := newTestClient(t, srv)
+	alice.signUp("alice")
+	for i := 1; i <= 5; i++ {
+		alice.postMemo(fmt.Sprintf("memo %d", i), i == 2 || i == 4)
+	}
+	anon := newTestClient(t, srv)
+
+	tests := []struct {
+		c            *testClient
+		id           int
+		older, newer int
+		who          string
+	}{
+		// the owner steps through every memo, oldest to newest
+		{alice, 1, 0, 2, "owner"},
+		{alice, 3, 2, 4, "owner"},
+		{alice, 5, 4, 0, "owner"},
+		// everybody else skips the private 2 and 4
+		{anon, 1, 0, 3, "anonymous"},
+		{anon, 3, 1, 5, "anonymous"},
+		{anon, 5, 3, 0, "anonymous"},
+	}
+	for _, tt := range tests {
+		older, newer := olderNewer(tt.c.get(fmt.Sprintf("/memo/%d", tt.id)).body)
+		if older != tt.older || newer != tt.newer {
+			t.Errorf("%s: memo %d links older %d newer %d, want %d %d", tt.who, tt.id, older, newer, tt.older, tt.newer)
+		}
+	}
+
+	// a restored memo goes back into its place, not to the end
+	sid := alice.sid()
+	alice.post("/memo/3/delete", url.Values{"sid": {sid}})
+	if older, newer := olderNewer(alice.get("/memo/4").body); older != 2 || newer != 5 {
+		t.Errorf("after deleting 3: memo 4 links %d %d", older, newer)
+	}
+	alice.post("/trash/3/restore", url.Values{"sid": {sid}})
+	for _, tt := range tests {
+		if tt.id != 3 {
+			continue
+		}
+		older, newer := olderNewer(tt.c.get("/memo/3").body)
+		if older != tt.older || newer != tt.newer {
+			t.Errorf("%s: restored memo 3 links older %d newer %d, want %d %d", tt.who, older, newer, tt.older, tt.newer)
+		}
+	}
+	checkIds(t, "top after restore", memoLinks(anon.get("/").body, "memos"), 5, 3, 1)
+}
+
+func TestInitRebuildsIndex(t *testing.T) {
+	app, srv := newTestServer(t, nil)
+	alice := newTestClient(t, srv)
+	alice.signUp("alice")
+	alice.postMemo("one #a", false)
+	alice.postMemo("two", true)
+	alice.postMemo("three #a", false)
+
+	app.Index.Reset()
+	anon := newTestClient(t, srv)
+	if res := anon.get("/readyz"); res.code != http.StatusServiceUnavailable {
+		t.Errorf("readyz with an empty index = %d", res.code)
+	}
+	if res := anon.get("/init"); res.code != http.StatusOK || res.body != "ok" {
+		t.Fatalf("init = %d %q", res.code, res.body)
+	}
+	ids, _ := app.Index.PublicMemos(0, 10)
+	checkIds(t, "public list", ids, 3, 1)
+	ids, _ = app.Index.UserMemos(1)
+	checkIds(t, "user list", ids, 1, 2, 3)
+	ids, _, _ = app.Index.TagMemos("a", 0, 10)
+	checkIds(t, "tag a", ids, 3, 1)
+	if res := anon.get("/readyz"); res.code != http.StatusOK {
+		t.Errorf("readyz after init = %d\n%s", res.code, res.body)
+	}
+	if got := app.getUserName(1); got != "alice" {
+		t.Errorf("names after init: %q", got)
+	}
+}
+
+func TestTokensAndAPI(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	alice := newTestClient(t, srv)
+	alice.signUp("alice")
+
+	// the token is in the response to the POST only, not in the session
+	res := alice.post("/tokens", url.Values{"sid": {alice.sid()}, "name": {"ci"}, "scope": {"write"}})
+	m := regexp.MustCompile(`<code>([0-9a-f]+)</code>`).FindStringSubmatch(res.body)
+	if res.code != http.StatusOK || m == nil {
+		t.Fatalf("create token = %d, new token not shown:\n%s", res.code, res.body)
+	}
+	if strings.Contains(alice.get("/mypage").body, m[1]) {
+		t.Error("token shown twice")
+	}
+
+	script := newTestClient(t, srv)
+	script.header.Set("Authorization", "Bearer "+m[1])
+	if res := script.get("/api/v1/me"); res.code != http.StatusOK || !strings.Contains(res.body, `"username":"alice"`) {
+		t.Errorf("me = %d %s", res.code, res.body)
+	}
+	res = script.postJSON("/api/v1/memos", map[string]interface{}{"content": "from ci", "tags": []string{"ci"}})
+	if res.code != http.StatusCreated || res.location != "/api/v1/memos/1" || !strings.Contains(res.body, `"tags":["ci"]`) {
+		t.Errorf("api post = %d %s %s", res.code, res.location, res.body)
+	}
+	if res := script.get("/api/v1/me/memos"); !strings.Contains(res.body, "from ci") {
+		t.Errorf("me/memos = %s", res.body)
+	}
+	if res := script.get("/api/v1/memos/1"); res.code != http.StatusOK {
+		t.Errorf("api memo = %d", res.code)
+	}
+	if res := script.post("/tokens", nil); res.code != http.StatusForbidden {
+		t.Errorf("token creating a token = %d", res.code)
+	}
+
+	if res := alice.post("/tokens/1/revoke", url.Values{"sid": {alice.sid()}}); res.code != http.StatusFound {
+		t.Fatalf("revoke = %d", res.code)
+	}
+	if res := script.get("/api/v1/me"); res.code != http.StatusUnauthorized {
+		t.Errorf("me with a revoked token = %d", res.code)
+	}
+	if res := alice.post("/tokens/1/revoke", url.Values{"sid": {alice.sid()}}); res.code != http.StatusNotFound {
+		t.Errorf("revoke twice = %d", res.code)
+	}
+}
+
+func TestPublicRoutes(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	alice := newTestClient(t, srv)
+	alice.signUp("alice")
+	alice.postMemo("hello #go", false)
+
+	tests := []struct {
+		path string
+		code int
+		want string
+	}{
+		{"/", http.StatusOK, "hello"},
+		{"/recent/0", http.StatusOK, "hello"},
+		{"/tag/go", http.StatusOK, "hello"},
+		{"/tag/go/1", http.StatusNotFound, ""},
+		{"/tag/nothing", http.StatusNotFound, ""},
+		{"/signin", http.StatusOK, `name="password"`},
+		{"/signup", http.StatusOK, `name="password_confirm"`},
+		{"/search?q=hello", http.StatusOK, "<mark>hello</mark>"},
+		{"/search?q=h", http.StatusOK, "at least 2"},
+		{"/api/v1/search?q=hello", http.StatusOK, `"has_more":false`},
+		{"/api/v1/search?q=h", http.StatusBadRequest, "at least 2"},
+		{"/recent.atom", http.StatusOK, "<entry>"},
+		{"/recent.rss", http.StatusOK, "<item>"},
+		{"/user/alice.atom", http.StatusOK, "<entry>"},
+		{"/user/nobody.atom", http.StatusNotFound, ""},
+		{"/memo/1", http.StatusOK, "hello"},
+		{"/memo/99", http.StatusNotFound, ""},
+		{"/memo/abc", http.StatusNotFound, ""},
+		{"/api/v1/memos", http.StatusOK, `"total":1`},
+		{"/api/v1/me", http.StatusUnauthorized, "authentication required"},
+		{"/api/v1/nothing", http.StatusNotFound, `"error"`},
+		{"/healthz", http.StatusOK, "ok"},
+		{"/readyz", http.StatusOK, `"ready":true`},
+		{"/favicon.ico", http.StatusOK, ""},
+		{"/metrics", http.StatusOK, "isucon_http_requests_total"},
+	}
+	anon := newTestClient(t, srv)
+	for _, tt := range tests {
+		res := anon.get(tt.path)
+		if res.code != tt.code || !strings.Contains(res.body, tt.want) {
+			t.Errorf("GET %s = %d, want %d with %q\n%.300s", tt.path, res.code, tt.code, tt.want, res.body)
+		}
+	}
+}
+
+func TestEmptyFeedIsStable(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	anon := newTestClient(t, srv)
+	res := anon.get("/recent.atom")
+	if res.code != http.StatusOK || !strings.Contains(res.body, "<updated>1970-01-01T00:00:00Z</updated>") {
+		t.Fatalf("empty feed = %d\n%s", res.code, res.body)
+	}
+	anon.header.Set("If-None-Match", fmt.Sprintf(`"%x"`, md5.Sum([]byte(res.body))))
+	if res := anon.get("/recent.atom"); res.code != http.StatusNotModified {
+		t.Errorf("conditional GET of the empty feed = %d", res.code)
+	}
+}
+
+func TestAPIUserLookupErrorIsOneJSONResponse(t *testing.T) {
+	app := newTestApp(t, nil)
+	h := app.Router(false)
+	for _, path := range []string{"/api/v1/me", "/api/v1/memos/1", "/api/v1/me/memos", "/api/v1/search?q=go"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer some-token")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var body apiErrorBody
+		dec := json.NewDecoder(w.Body)
+		if err := dec.Decode(&body); err != nil || w.Code != http.StatusInternalServerError || body.RequestID == "" {
+			t.Errorf("%s: %d %+v %v", path, w.Code, body, err)
+		}
+		if dec.More() {
+			t.Errorf("%s: more after the JSON error", path)
+		}
+	}
+}
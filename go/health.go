@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"./sessions"
+)
+
+// /healthz answers as long as the process can serve HTTP. /readyz answers
+// 200 only when MySQL, Redis and memcache respond, the user names are
+// loaded, the index has been built by rebuildIndex and the process is not
+// draining; otherwise 503, so a load balancer stops sending traffic. With
+// the memory storage there is nothing to check but the last three.
+
+const readyCheckTimeout = time.Second
+
+type dependencyStatus struct {
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready         bool                         `json:"ready"`
+	Checks        map[string]*dependencyStatus `json:"checks"`
+	NamesLoaded   bool                         `json:"names_loaded"`
+	RedisMigrated bool                         `json:"redis_migrated"`
+	Draining      bool                         `json:"draining"`
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	apiJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (app *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+	defer cancel()
+
+	var migrated bool
+	checks := make(map[string]func() error)
+	if app.DB != nil {
+		checks["mysql"] = func() error {
+			return app.DB.PingContext(ctx)
+		}
+	}
+	if app.Redis != nil {
+		checks["redis"] = func() error {
+			var err error
+			migrated, err = (&redisIndex{pool: app.Redis}).migratedContext(ctx)
+			return err
+		}
+	} else {
+		migrated, _ = app.Index.Migrated()
+	}
+	if store, ok := app.Sessions.(*sessions.MemcacheStore); ok {
+		checks["memcache"] = func() error {
+			return store.Memcache.Ping()
+		}
+	}
+
+	status := &readiness{
+		Checks:      make(map[string]*dependencyStatus, len(checks)),
+		NamesLoaded: atomic.LoadInt32(&app.namesLoaded) == 1,
+		Draining:    atomic.LoadInt32(&app.draining) == 1,
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() error) {
+			defer wg.Done()
+			start := time.Now()
+			err := check()
+			s := &dependencyStatus{OK: err == nil, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				s.Error = err.Error()
+			}
+			mu.Lock()
+			status.Checks[name] = s
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status.RedisMigrated = migrated
+	status.Ready = status.NamesLoaded && status.RedisMigrated && !status.Draining
+	for _, s := range status.Checks {
+		status.Ready = status.Ready && s.OK
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	apiJSON(w, code, status)
+}
+
+// loadNames runs initNames at startup, retrying until MySQL is reachable.
+func (app *App) loadNames() {
+	for {
+		err := app.initNames()
+		if err == nil {
+			return
+		}
+		log.Printf("error: load names: %s", err)
+		time.Sleep(time.Second)
+	}
+}
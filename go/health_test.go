@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("healthz = %d %v", w.Code, body)
+	}
+}
+
+// With every Redis connection taken, /readyz must fail within its deadline
+// rather than wait for one.
+func TestReadyzRedisPoolExhausted(t *testing.T) {
+	app := newTestApp(t, nil)
+	app.Redis = &redis.Pool{
+		MaxActive: 1,
+		Wait:      true,
+		Dial: func() (redis.Conn, error) {
+			c, _ := net.Pipe()
+			return redis.NewConn(c, 0, 0), nil
+		},
+	}
+	app.Index = &redisIndex{pool: app.Redis}
+	busy := app.Redis.Get()
+	defer busy.Close()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		app.readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+		done <- w
+	}()
+	select {
+	case w := <-done:
+		var body readiness
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusServiceUnavailable || body.Checks["redis"] == nil || body.Checks["redis"].OK {
+			t.Errorf("readyz = %d %s", w.Code, w.Body)
+		}
+	case <-time.After(3 * readyCheckTimeout):
+		t.Fatal("readyz waited on the exhausted pool")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/russross/blackfriday"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+// With the highlight extension, fenced code that names a language chroma
+// knows is rendered as
+//
+//	<pre class="chroma"><code class="language-go"><span class="kd">func</span>...
+//
+// The spans carry classes only; public/css/highlight.css colours them and
+// is made by -highlight-css. Code in other languages renders as before.
+
+var highlightCSS = flag.String("highlight-css", "", "print the stylesheet for the named chroma style (e.g. github) and exit")
+
+var (
+	highlightFormatter = chromahtml.New(chromahtml.WithClasses(true), chromahtml.PreventSurroundingPre(true))
+
+	// highlightClass matches the classes chroma puts on spans.
+	highlightClass = regexp.MustCompile(`^(` + strings.Join(chromaClasses(), "|") + `)$`)
+
+	languageClass = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+func chromaClasses() []string {
+	var cs []string
+	for _, c := range chroma.StandardTypes {
+		if c != "" {
+			cs = append(cs, regexp.QuoteMeta(c))
+		}
+	}
+	sort.Strings(cs)
+	return cs
+}
+
+// highlightCode returns code highlighted as lang, or false if chroma has
+// no lexer for lang.
+func highlightCode(lang string, code []byte) ([]byte, bool) {
+	if lang == "" {
+		return nil, false
+	}
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		return nil, false
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, string(code))
+	if err != nil {
+		return nil, false
+	}
+	var out bytes.Buffer
+	out.WriteString(`<pre class="chroma"><code`)
+	// The lexer's own alias rather than lang, which may be anything.
+	for _, a := range lexer.Config().Aliases {
+		if languageClass.MatchString(a) {
+			out.WriteString(` class="language-` + a + `"`)
+			break
+		}
+	}
+	out.WriteString(">")
+	if err := highlightFormatter.Format(&out, styles.Fallback, it); err != nil {
+		return nil, false
+	}
+	out.WriteString("</code></pre>\n")
+	return out.Bytes(), true
+}
+
+// writeHighlightCSS writes the stylesheet for the chroma style named.
+func writeHighlightCSS(w io.Writer, style string) error {
+	s, ok := styles.Registry[style]
+	if !ok {
+		return fmt.Errorf("highlight: unknown style %q", style)
+	}
+	return highlightFormatter.WriteCSS(w, s)
+}
+
+// blackfridayHighlighter is a blackfriday renderer that highlights code
+// blocks and leaves everything else to the one it wraps.
+type blackfridayHighlighter struct {
+	blackfriday.Renderer
+}
+
+func (r blackfridayHighlighter) BlockCode(out *bytes.Buffer, text []byte, info string) {
+	// blackfriday takes the first word of the info string, less any
+	// leading dot, as the language.
+	var lang string
+	if f := strings.Fields(info); len(f) > 0 {
+		lang = strings.TrimPrefix(f[0], ".")
+	}
+	h, ok := highlightCode(lang, text)
+	if !ok {
+		r.Renderer.BlockCode(out, text, info)
+		return
+	}
+	if out.Len() > 0 {
+		out.WriteByte('\n')
+	}
+	out.Write(h)
+}
+
+// goldmarkHighlighter renders fenced code blocks for goldmark in place of
+// its html renderer.
+type goldmarkHighlighter struct{}
+
+func (goldmarkHighlighter) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, renderFencedCode)
+}
+
+func renderFencedCode(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.FencedCodeBlock)
+	var code bytes.Buffer
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		code.Write(seg.Value(source))
+	}
+	lang := n.Language(source)
+	if h, ok := highlightCode(string(lang), code.Bytes()); ok {
+		w.Write(h)
+		return ast.WalkContinue, nil
+	}
+	// As goldmark's own renderer does it.
+	w.WriteString("<pre><code")
+	if lang != nil {
+		w.WriteString(` class="language-`)
+		gmhtml.DefaultWriter.Write(w, lang)
+		w.WriteString(`"`)
+	}
+	w.WriteString(">")
+	gmhtml.DefaultWriter.RawWrite(w, code.Bytes())
+	w.WriteString("</code></pre>\n")
+	return ast.WalkContinue, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestHighlightFencedCode(t *testing.T) {
+	for _, engine := range []string{engineBlackfriday, engineCommonMark, engineGFM} {
+		r, err := newMarkdownRenderer(MarkdownConfig{Engine: engine})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			md, want string
+		}{
+			{"```go\nfunc main() {}\n```\n", `<pre class="chroma"><code class="language-go"><span class="kd">func</span>`},
+			{"```Python\nimport os\n```\n", `<pre class="chroma"><code class="language-python"><span class="kn">import</span>`},
+			{"```nosuchlang\n<x>\n```\n", `<pre><code class="language-nosuchlang">&lt;x&gt;`},
+			{"```\n<x>\n```\n", "<pre><code>&lt;x&gt;"},
+			{"    func main() {}\n", "<pre><code>func main() {}"},
+		}
+		for _, tt := range tests {
+			if got := string(r.render([]byte(tt.md))); !strings.Contains(got, tt.want) {
+				t.Errorf("%s: render(%q) = %q, want it to contain %q", engine, tt.md, got, tt.want)
+			}
+		}
+
+		r, err = newMarkdownRenderer(MarkdownConfig{Engine: engine, Extensions: []string{"fenced_code"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(r.render([]byte("```go\nx := 1\n```\n"))); !strings.Contains(got, `<pre><code class="language-go">x := 1`) {
+			t.Errorf("%s without highlight: render = %q", engine, got)
+		}
+	}
+}
+
+func TestHighlightedHTMLSurvivesSanitizer(t *testing.T) {
+	app := newTestApp(t, nil)
+	for _, md := range []string{
+		"```go\npackage main\n\n// comment\nfunc main() { fmt.Println(\"hi\", 1.5, 'x') }\n```",
+		"```html\n<script>alert(1)</script>\n<a href=\"javascript:x\" onclick=\"y\">z</a>\n```",
+		"```js\nconst s = `${a}` /* c */; document.write('<img onerror=x>');\n```",
+		"```sql\nSELECT * FROM memos WHERE id = ? -- note\n```",
+		"```sh\necho \"$HOME\" | grep -v x >/dev/null 2>&1\n```",
+		"```c++\n#include <vector>\nint main() { return 0; }\n```",
+		"```diff\n- old\n+ new\n```",
+		"```ruby\nputs \"#{x}\" if x =~ /re/\n```",
+	} {
+		raw := app.Renderer.render([]byte(md))
+		if !bytes.Contains(raw, []byte(`<pre class="chroma">`)) {
+			t.Errorf("%q not highlighted: %s", md, raw)
+			continue
+		}
+		if got := app.Sanitizer.sanitize(raw); !bytes.Equal(got, raw) {
+			t.Errorf("sanitize changed highlighted %q:\n%s\nto\n%s", md, raw, got)
+		}
+		checkSafeHTML(t, md, string(app.genMarkdown("", md)))
+	}
+}
+
+func TestHighlightCSS(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeHighlightCSS(&b, "github"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), ".chroma .kd {") {
+		t.Errorf("no rule for .kd in %s", b.String())
+	}
+	css, err := ioutil.ReadFile("public/css/highlight.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(css, []byte(".chroma .kd {")) {
+		t.Error("public/css/highlight.css is not a -highlight-css stylesheet")
+	}
+	if err := writeHighlightCSS(&b, "no-such-style"); err == nil {
+		t.Error("an unknown style was accepted")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// indexTests run against both MemoIndex implementations: memIndex always,
+// and redisIndex when a Redis answers at ISUCON_TEST_REDIS_ADDR (default
+// localhost:6379). The Redis tests use database 15 and flush it.
+var indexTests = []struct {
+	name string
+	test func(t *testing.T, x MemoIndex)
+}{
+	{"Lists", testIndexLists},
+	{"TagsAndSearch", testIndexTagsAndSearch},
+	{"Reset", testIndexReset},
+}
+
+func TestMemIndex(t *testing.T) {
+	for _, tt := range indexTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newMemIndex())
+		})
+	}
+}
+
+func TestRedisIndex(t *testing.T) {
+	addr := os.Getenv("ISUCON_TEST_REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr,
+				redis.DialDatabase(15),
+				redis.DialConnectTimeout(500*time.Millisecond),
+			)
+		},
+	}
+	defer pool.Close()
+	c := pool.Get()
+	_, err := c.Do("PING")
+	c.Close()
+	if err != nil {
+		t.Skipf("no Redis at %s: %v", addr, err)
+	}
+	x := &redisIndex{pool, time.Second}
+	for _, tt := range indexTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := x.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			tt.test(t, x)
+		})
+	}
+
+	c = pool.Get()
+	defer c.Close()
+	if _, err := c.Do("SET", "login_wait:user:alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := redis.Int(c.Do("EXISTS", "login_wait:user:alice")); err != nil || n != 1 {
+		t.Errorf("Reset removed a login throttle key: %d, %v", n, err)
+	}
+	c.Do("FLUSHDB")
+}
+
+func TestIsRedisIndexKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"public_memos":                  true,
+		"user_memos:3":                  true,
+		"user_tag_cloud:3":              true,
+		"tag_public_memos:go":           true,
+		"search:is":                     true,
+		"index_migrated_at":             true,
+		"public_memo_list":              true,
+		"user_public_memo_list:3":       true,
+		"login_failures:ip:192.0.2.1":   false,
+		"login_wait:user:alice":         false,
+		"md:3.0123456789abcdef:0123abc": false,
+	} {
+		if got := isRedisIndexKey(key); got != want {
+			t.Errorf("isRedisIndexKey(%q) = %v", key, got)
+		}
+	}
+}
+
+func testIndexLists(t *testing.T, x MemoIndex) {
+	memos := []*Memo{
+		{Id: 1, User: 1},
+		{Id: 2, User: 1, IsPrivate: 1},
+		{Id: 3, User: 2},
+		{Id: 4, User: 1},
+	}
+	if err := x.Add(memos...); err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, got []int, want string) {
+		t.Helper()
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s = %v, want %s", name, got, want)
+		}
+	}
+	ids, _ := x.PublicMemos(0, 10)
+	check("PublicMemos", ids, "[4 3 1]")
+	ids, _ = x.PublicMemos(1, 1)
+	check("PublicMemos page", ids, "[3]")
+	ids, _ = x.UserMemos(1)
+	check("UserMemos", ids, "[1 2 4]")
+
+	x.Remove(memos[0])
+	x.Remove(memos[3])
+	x.Restore(memos[0])
+	ids, _ = x.UserMemos(1)
+	check("UserMemos after restore", ids, "[1 2]")
+
+	public := *memos[1]
+	public.IsPrivate = 0
+	x.Update(memos[1], &public)
+	ids, _ = x.PublicMemos(0, 10)
+	check("PublicMemos after publish", ids, "[3 2 1]")
+	ids, _ = x.UserPublicMemos(1, 0, 10)
+	check("UserPublicMemos", ids, "[2 1]")
+	if n, _ := x.PublicMemoCount(); n != 3 {
+		t.Errorf("PublicMemoCount = %d", n)
+	}
+}
+
+func testIndexTagsAndSearch(t *testing.T, x MemoIndex) {
+	a := &Memo{Id: 1, User: 1, Content: "ISUCON 予選", Tags: []string{"go", "isucon"}}
+	b := &Memo{Id: 2, User: 1, Content: "ISUCON 本選", Tags: []string{"go"}, IsPrivate: 1}
+	x.Add(a, b)
+
+	ids, total, _ := x.TagMemos("go", 0, 10)
+	if fmt.Sprint(ids) != "[1]" || total != 1 {
+		t.Errorf("TagMemos(go) = %v, %d", ids, total)
+	}
+	ids, _ = x.UserTagMemos(1, "go")
+	if fmt.Sprint(ids) != "[1 2]" {
+		t.Errorf("UserTagMemos(go) = %v", ids)
+	}
+	cloud, _ := x.UserTagCloud(1)
+	if len(cloud) != 2 || cloud[0].Name != "go" || cloud[0].Count != 2 {
+		t.Errorf("UserTagCloud = %v", cloud)
+	}
+
+	ids, _ = x.Search(queryGrams(searchTerms("isucon")))
+	sort.Ints(ids)
+	if fmt.Sprint(ids) != "[1 2]" {
+		t.Errorf("Search(isucon) = %v", ids)
+	}
+	ids, _ = x.Search(queryGrams(searchTerms("予選")))
+	if fmt.Sprint(ids) != "[1]" {
+		t.Errorf("Search(予選) = %v", ids)
+	}
+
+	x.Remove(a)
+	cloud, _ = x.TagCloud()
+	if len(cloud) != 0 {
+		t.Errorf("TagCloud after removing the only public memo = %v", cloud)
+	}
+	ids, _ = x.Search(queryGrams(searchTerms("予選")))
+	if len(ids) != 0 {
+		t.Errorf("Search(予選) after remove = %v", ids)
+	}
+}
+
+func testIndexReset(t *testing.T, x MemoIndex) {
+	if err := x.Add(&Memo{Id: 1, User: 1, Content: "ISUCON", Tags: []string{"go"}}); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := x.PublicUpdated(); err != nil || updated.IsZero() {
+		t.Errorf("PublicUpdated after Add = %v, %v", updated, err)
+	}
+	if err := x.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := x.UserMemos(1); len(ids) != 0 {
+		t.Errorf("UserMemos after Reset = %v", ids)
+	}
+	if ids, _ := x.Search(queryGrams(searchTerms("isucon"))); len(ids) != 0 {
+		t.Errorf("Search after Reset = %v", ids)
+	}
+	if cloud, _ := x.TagCloud(); len(cloud) != 0 {
+		t.Errorf("TagCloud after Reset = %v", cloud)
+	}
+	if updated, _ := x.UserPublicUpdated(1); !updated.IsZero() {
+		t.Errorf("UserPublicUpdated after Reset = %v", updated)
+	}
+	if migrated, err := x.Migrated(); err != nil || migrated {
+		t.Errorf("Migrated after Reset = %v, %v", migrated, err)
+	}
+	if err := x.MarkMigrated(); err != nil {
+		t.Fatal(err)
+	}
+	if migrated, err := x.Migrated(); err != nil || !migrated {
+		t.Errorf("Migrated after MarkMigrated = %v, %v", migrated, err)
+	}
+}
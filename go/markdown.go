@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/russross/blackfriday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+// Memo Markdown is turned into HTML by one of these engines:
+//
+//	blackfriday  blackfriday v1, as MarkdownCommon has it (the default)
+//	commonmark   goldmark, following the CommonMark spec
+//	gfm          goldmark with the GitHub Flavored Markdown extensions
+//	markdown.pl  a port of bin/markdown (Markdown.pl 1.0.1), which the
+//	             other implementations of the app use; see markdownpl.go
+//
+// Either way the result is sanitised afterwards (see sanitize.go), so the
+// engines pass raw HTML through.
+
+// MarkdownConfig is the markdown section of the config file.
+type MarkdownConfig struct {
+	// Engine is "blackfriday", "commonmark", "gfm" or "markdown.pl".
+	Engine string `json:"engine"`
+	// Extensions replaces the engine's default extensions; see
+	// markdownExtensions. Leave it out for the defaults, or give [] for
+	// none.
+	Extensions []string `json:"extensions"`
+}
+
+const (
+	engineBlackfriday = "blackfriday"
+	engineCommonMark  = "commonmark"
+	engineGFM         = "gfm"
+	engineMarkdownPL  = "markdown.pl"
+)
+
+// markdownExtensions are the names allowed in markdown.extensions.
+// fenced_code is part of CommonMark, so it is always on in commonmark and
+// gfm whether listed or not; task_lists is only available there.
+// highlight colours fenced code by its language (see highlight.go).
+var markdownExtensions = map[string]bool{
+	"tables":           true,
+	"fenced_code":      true,
+	"footnotes":        true,
+	"autolink":         true,
+	"strikethrough":    true,
+	"hard_line_breaks": true,
+	"heading_anchors":  true,
+	"task_lists":       true,
+	"highlight":        true,
+}
+
+var defaultMarkdownExtensions = map[string][]string{
+	engineBlackfriday: {"tables", "fenced_code", "autolink", "strikethrough", "highlight"},
+	engineCommonMark:  {"fenced_code", "highlight"},
+	engineGFM:         {"tables", "fenced_code", "autolink", "strikethrough", "task_lists", "highlight"},
+	engineMarkdownPL:  {},
+}
+
+type markdownRenderer interface {
+	render(md []byte) []byte
+	// version names the engine and its options. It is part of the render
+	// cache key, so it must change whenever the output may.
+	version() string
+}
+
+func newMarkdownRenderer(c MarkdownConfig) (markdownRenderer, error) {
+	engine := c.Engine
+	if engine == "" {
+		engine = engineBlackfriday
+	}
+	defaults, ok := defaultMarkdownExtensions[engine]
+	if !ok {
+		return nil, fmt.Errorf("markdown: unknown engine %q", c.Engine)
+	}
+	exts := c.Extensions
+	if exts == nil {
+		exts = defaults
+	}
+	set := make(map[string]bool)
+	for _, e := range exts {
+		if !markdownExtensions[e] {
+			return nil, fmt.Errorf("markdown: unknown extension %q", e)
+		}
+		set[e] = true
+	}
+	names := make([]string, 0, len(set))
+	for e := range set {
+		names = append(names, e)
+	}
+	sort.Strings(names)
+	version := engine + ":" + strings.Join(names, ",")
+
+	switch engine {
+	case engineMarkdownPL:
+		if len(names) > 0 {
+			return nil, fmt.Errorf("markdown: markdown.pl takes no extensions")
+		}
+		return &markdownPLRenderer{version}, nil
+	case engineBlackfriday:
+		if set["task_lists"] {
+			return nil, fmt.Errorf("markdown: task_lists needs the commonmark or gfm engine")
+		}
+		return newBlackfridayRenderer(names, version), nil
+	}
+	return newGoldmarkRenderer(names, version), nil
+}
+
+// blackfridayRenderer renders as blackfriday.MarkdownCommon does when
+// given the default extensions other than highlight.
+type blackfridayRenderer struct {
+	flags      int
+	extensions int
+	highlight  bool
+	v          string
+}
+
+const (
+	blackfridayHTMLFlags = blackfriday.HTML_USE_XHTML |
+		blackfriday.HTML_USE_SMARTYPANTS |
+		blackfriday.HTML_SMARTYPANTS_FRACTIONS |
+		blackfriday.HTML_SMARTYPANTS_DASHES |
+		blackfriday.HTML_SMARTYPANTS_LATEX_DASHES
+
+	// blackfridayBaseExtensions are the rest of MarkdownCommon's.
+	blackfridayBaseExtensions = blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+		blackfriday.EXTENSION_SPACE_HEADERS |
+		blackfriday.EXTENSION_HEADER_IDS |
+		blackfriday.EXTENSION_BACKSLASH_LINE_BREAK |
+		blackfriday.EXTENSION_DEFINITION_LISTS
+)
+
+var blackfridayExtensions = map[string]int{
+	"tables":           blackfriday.EXTENSION_TABLES,
+	"fenced_code":      blackfriday.EXTENSION_FENCED_CODE,
+	"footnotes":        blackfriday.EXTENSION_FOOTNOTES,
+	"autolink":         blackfriday.EXTENSION_AUTOLINK,
+	"strikethrough":    blackfriday.EXTENSION_STRIKETHROUGH,
+	"hard_line_breaks": blackfriday.EXTENSION_HARD_LINE_BREAK,
+	"heading_anchors":  blackfriday.EXTENSION_AUTO_HEADER_IDS,
+}
+
+func newBlackfridayRenderer(exts []string, version string) *blackfridayRenderer {
+	r := &blackfridayRenderer{
+		flags:      blackfridayHTMLFlags,
+		extensions: blackfridayBaseExtensions,
+		v:          version,
+	}
+	for _, e := range exts {
+		r.extensions |= blackfridayExtensions[e]
+		if e == "highlight" {
+			r.highlight = true
+		}
+	}
+	return r
+}
+
+func (r *blackfridayRenderer) render(md []byte) []byte {
+	html := blackfriday.HtmlRenderer(r.flags, "", "")
+	if r.highlight {
+		html = blackfridayHighlighter{html}
+	}
+	return blackfriday.MarkdownOptions(md, html, blackfriday.Options{Extensions: r.extensions})
+}
+
+func (r *blackfridayRenderer) version() string {
+	return r.v
+}
+
+type goldmarkRenderer struct {
+	md goldmark.Markdown
+	v  string
+}
+
+func newGoldmarkRenderer(exts []string, version string) *goldmarkRenderer {
+	var extenders []goldmark.Extender
+	var parserOpts []parser.Option
+	rendererOpts := []renderer.Option{gmhtml.WithUnsafe(), gmhtml.WithXHTML()}
+	for _, e := range exts {
+		switch e {
+		case "tables":
+			extenders = append(extenders, extension.Table)
+		case "footnotes":
+			extenders = append(extenders, extension.Footnote)
+		case "autolink":
+			extenders = append(extenders, extension.Linkify)
+		case "strikethrough":
+			extenders = append(extenders, extension.Strikethrough)
+		case "task_lists":
+			extenders = append(extenders, extension.TaskList)
+		case "hard_line_breaks":
+			rendererOpts = append(rendererOpts, gmhtml.WithHardWraps())
+		case "heading_anchors":
+			parserOpts = append(parserOpts, parser.WithAutoHeadingID())
+		case "highlight":
+			rendererOpts = append(rendererOpts, renderer.WithNodeRenderers(util.Prioritized(goldmarkHighlighter{}, 100)))
+		}
+	}
+	return &goldmarkRenderer{
+		md: goldmark.New(
+			goldmark.WithExtensions(extenders...),
+			goldmark.WithParserOptions(parserOpts...),
+			goldmark.WithRendererOptions(rendererOpts...),
+		),
+		v: version,
+	}
+}
+
+func (r *goldmarkRenderer) render(md []byte) []byte {
+	var out bytes.Buffer
+	// Convert fails only when writing does, which a bytes.Buffer does not.
+	r.md.Convert(md, &out)
+	return out.Bytes()
+}
+
+func (r *goldmarkRenderer) version() string {
+	return r.v
+}
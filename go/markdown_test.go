@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/russross/blackfriday"
+)
+
+func TestBlackfridayMatchesMarkdownCommon(t *testing.T) {
+	r, err := newMarkdownRenderer(MarkdownConfig{Extensions: []string{"tables", "fenced_code", "autolink", "strikethrough"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, md := range []string{
+		"# Title {#top}\n\nsome_snake_case -- \"quotes\" 1/2\n",
+		"| a | b |\n|---|--:|\n| 1 | 2 |\n",
+		"```go\nx := 1\n```\n\nhttps://example.com ~~gone~~\n",
+		"term\n: definition\n\nline\\\nbreak\n",
+		"text[^1]\n\n[^1]: not a footnote\n",
+	} {
+		if got, want := r.render([]byte(md)), blackfriday.MarkdownCommon([]byte(md)); !bytes.Equal(got, want) {
+			t.Errorf("render(%q) =\n%s\nMarkdownCommon =\n%s", md, got, want)
+		}
+	}
+}
+
+func TestMarkdownEngines(t *testing.T) {
+	tests := []struct {
+		config   MarkdownConfig
+		md       string
+		want     []string
+		dontWant []string
+	}{
+		{
+			config:   MarkdownConfig{Engine: engineCommonMark},
+			md:       "~~x~~ https://example.com\n\n| a |\n|---|\n| 1 |\n",
+			want:     []string{"~~x~~ https://example.com", "| a |"},
+			dontWant: []string{"<del>", "<a ", "<table>"},
+		},
+		{
+			config: MarkdownConfig{Engine: engineGFM},
+			md:     "~~x~~ https://example.com\n\n- [x] done\n\n| a |\n|---|\n| 1 |\n",
+			want: []string{
+				"<del>x</del>",
+				`<a href="https://example.com">`,
+				`<input checked="" disabled="" type="checkbox" />`,
+				"<td>1</td>",
+			},
+		},
+		{
+			config:   MarkdownConfig{Engine: engineGFM, Extensions: []string{}},
+			md:       "~~x~~\n\n```\ncode\n```\n",
+			want:     []string{"~~x~~", "<pre><code>code\n</code></pre>"},
+			dontWant: []string{"<del>"},
+		},
+		{
+			config: MarkdownConfig{Extensions: []string{"hard_line_breaks", "heading_anchors", "footnotes"}},
+			md:     "# Hello World\n\none\ntwo[^1]\n\n[^1]: note\n",
+			want:   []string{`<h1 id="hello-world">`, "one<br />\ntwo", `<li id="fn:1">`},
+		},
+		{
+			config: MarkdownConfig{Engine: engineCommonMark, Extensions: []string{"hard_line_breaks", "heading_anchors", "footnotes"}},
+			md:     "# Hello World\n\none\ntwo[^1]\n\n[^1]: note\n",
+			want:   []string{`<h1 id="hello-world">`, "one<br />\ntwo", `<li id="fn:1">`},
+		},
+		{
+			config:   MarkdownConfig{Extensions: []string{"tables"}},
+			md:       "```\ncode\n```\n",
+			dontWant: []string{"<pre>"},
+		},
+	}
+	for _, tt := range tests {
+		r, err := newMarkdownRenderer(tt.config)
+		if err != nil {
+			t.Fatalf("%+v: %s", tt.config, err)
+		}
+		got := string(r.render([]byte(tt.md)))
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%+v: render(%q) = %q, want it to contain %q", tt.config, tt.md, got, w)
+			}
+		}
+		for _, w := range tt.dontWant {
+			if strings.Contains(got, w) {
+				t.Errorf("%+v: render(%q) = %q, want no %q", tt.config, tt.md, got, w)
+			}
+		}
+	}
+}
+
+func TestMarkdownConfigErrors(t *testing.T) {
+	for _, c := range []MarkdownConfig{
+		{Engine: "pandoc"},
+		{Extensions: []string{"emoji"}},
+		{Engine: engineBlackfriday, Extensions: []string{"task_lists"}},
+		{Engine: engineMarkdownPL, Extensions: []string{"tables"}},
+	} {
+		if _, err := newMarkdownRenderer(c); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+}
+
+func TestRenderCacheVersionFollowsMarkdownConfig(t *testing.T) {
+	version := func(c MarkdownConfig) string {
+		r, err := newMarkdownRenderer(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return renderCacheVersion(r, SanitizeConfig{})
+	}
+	base := version(MarkdownConfig{})
+	if v := version(MarkdownConfig{Engine: engineBlackfriday, Extensions: []string{"highlight", "strikethrough", "tables", "autolink", "fenced_code"}}); v != base {
+		t.Error("the default extensions spelt out in another order change the version")
+	}
+	for _, c := range []MarkdownConfig{
+		{Engine: engineGFM},
+		{Extensions: []string{"tables"}},
+		{Extensions: []string{"tables", "fenced_code", "autolink", "strikethrough", "heading_anchors"}},
+	} {
+		if version(c) == base {
+			t.Errorf("%+v has the default version", c)
+		}
+	}
+
+	a := newTestApp(t, nil)
+	b := newTestApp(t, func(c *Config) { c.Markdown.Engine = engineCommonMark })
+	md := "~~x~~"
+	a.cacheHTML("", md)
+	if _, found := b.renders.get(renderCacheKey(a.renderVersion, md)); found {
+		t.Fatal("b holds a's render")
+	}
+	if h := b.genMarkdown("", md); strings.Contains(string(h), "<del>") {
+		t.Errorf("commonmark render = %s", h)
+	}
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+)
+
+// markdownPLRenderer is a port of Markdown.pl 1.0.1 (bin/markdown), which
+// the other implementations of this app shell out to, so that memos render
+// to the same bytes. It follows the Perl sub by sub and regex by regex;
+// see testdata/markdownpl for the parity corpus.
+//
+// Perl runs those regexes over bytes with ASCII-only \s, \w and \b, so the
+// port maps each byte to the rune of the same value (Latin-1) before
+// matching and back afterwards, and spells the classes out as below.
+// regexp2 is used because the patterns need backreferences, lookbehind and
+// atomic groups. Two things cannot be reproduced: the recursive bracket
+// pattern is unrolled to a fixed depth (as PHP Markdown does), and email
+// autolinks are entity-encoded deterministically where Markdown.pl picks
+// an encoding per character at random.
+type markdownPLRenderer struct {
+	v string
+}
+
+func (r *markdownPLRenderer) render(md []byte) []byte {
+	p := &markdownPL{
+		urls:       make(map[string]string),
+		titles:     make(map[string]string),
+		htmlBlocks: make(map[string]string),
+	}
+	return fromLatin1(p.markdown(toLatin1(md)))
+}
+
+func (r *markdownPLRenderer) version() string {
+	return r.v
+}
+
+func toLatin1(b []byte) string {
+	rs := make([]rune, len(b))
+	for i, c := range b {
+		rs[i] = rune(c)
+	}
+	return string(rs)
+}
+
+func fromLatin1(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+const (
+	plTabWidth    = 4
+	plEmptySuffix = " />"
+
+	// Perl's \s, \S and \w on bytes.
+	plSpace    = `[ \t\n\x0B\f\r]`
+	plNonSpace = `[^ \t\n\x0B\f\r]`
+	plWord     = `[0-9A-Za-z_]`
+	// plWordEnd is \b right after a word character.
+	plWordEnd = `(?!` + plWord + `)`
+
+	// plNestedBracketsDepth bounds the recursion of $g_nested_brackets.
+	plNestedBracketsDepth = 6
+)
+
+func plRe(expr string, opts regexp2.RegexOptions) *regexp2.Regexp {
+	return regexp2.MustCompile(expr, opts)
+}
+
+const (
+	plM = regexp2.Multiline
+	plS = regexp2.Singleline
+)
+
+// plSubst is s/re/.../g with the replacement made by f.
+func plSubst(re *regexp2.Regexp, s string, f func(m regexp2.Match) string) string {
+	out, err := re.ReplaceFunc(s, f, -1, -1)
+	if err != nil {
+		// Only a match timeout fails, and none is set.
+		return s
+	}
+	return out
+}
+
+// plSubstOnce is s/re/.../ without /g.
+func plSubstOnce(re *regexp2.Regexp, s string, f func(m regexp2.Match) string) string {
+	out, err := re.ReplaceFunc(s, f, -1, 1)
+	if err != nil {
+		return s
+	}
+	return out
+}
+
+func plLiteral(repl string) func(regexp2.Match) string {
+	return func(regexp2.Match) string { return repl }
+}
+
+// plGroup is $n, with ok false where Perl's would be undef.
+func plGroup(m regexp2.Match, n int) (s string, ok bool) {
+	g := m.GroupByNumber(n)
+	if g == nil || len(g.Captures) == 0 {
+		return "", false
+	}
+	return g.String(), true
+}
+
+func plGroupString(m regexp2.Match, n int) string {
+	s, _ := plGroup(m, n)
+	return s
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum(fromLatin1(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// plLower is lc on bytes, which leaves everything but A-Z alone.
+func plLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+var (
+	plEscapeChars = "\\`*_{}[]()>#+-.!"
+	plEscapeTable = make(map[string]string)
+
+	plNestedBrackets = nestedBrackets(plNestedBracketsDepth)
+
+	plCodeEncoder          *strings.Replacer
+	plEmphasisEncoder      *strings.Replacer
+	plBackslashEscapes     []string
+	plUnescapeSpecialChars *strings.Replacer
+)
+
+func init() {
+	var unescape []string
+	for _, c := range plEscapeChars {
+		plEscapeTable[string(c)] = md5Hex(string(c))
+		unescape = append(unescape, plEscapeTable[string(c)], string(c))
+	}
+	plUnescapeSpecialChars = strings.NewReplacer(unescape...)
+	plEmphasisEncoder = strings.NewReplacer("*", plEscapeTable["*"], "_", plEscapeTable["_"])
+	plCodeEncoder = strings.NewReplacer(
+		"&", "&amp;", "<", "&lt;", ">", "&gt;",
+		"*", plEscapeTable["*"], "_", plEscapeTable["_"],
+		"{", plEscapeTable["{"], "}", plEscapeTable["}"],
+		"[", plEscapeTable["["], "]", plEscapeTable["]"],
+		`\`, plEscapeTable[`\`],
+	)
+	// In the order _EncodeBackslashEscapes applies them: \\ first.
+	for _, c := range "\\`*_{}[]()>#+-.!" {
+		plBackslashEscapes = append(plBackslashEscapes, `\`+string(c), plEscapeTable[string(c)])
+	}
+}
+
+// nestedBrackets unrolls
+//
+//	(?> [^\[\]]+ | \[ (??{ $g_nested_brackets }) \] )*
+//
+// to depth levels of brackets.
+func nestedBrackets(depth int) string {
+	re := `(?>[^\[\]]+)*`
+	for i := 0; i < depth; i++ {
+		re = `(?>[^\[\]]+|\[` + re + `\])*`
+	}
+	return re
+}
+
+// markdownPL holds what Markdown.pl keeps in globals for one document.
+type markdownPL struct {
+	urls       map[string]string
+	titles     map[string]string
+	htmlBlocks map[string]string
+	listLevel  int
+}
+
+var plBlankLine = plRe(`^[ \t]+$`, plM)
+
+func (p *markdownPL) markdown(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\r", "\n", -1)
+	text += "\n\n"
+	text = plDetab(text)
+	text = plSubst(plBlankLine, text, plLiteral(""))
+	text = p.hashHTMLBlocks(text)
+	text = p.stripLinkDefinitions(text)
+	text = p.runBlockGamut(text)
+	text = plUnescapeSpecialChars.Replace(text)
+	return text + "\n"
+}
+
+var plLinkDefinition = plRe(
+	`^[ ]{0,3}\[(.+)\]:[ \t]*\n?[ \t]*<?(`+plNonSpace+`+?)>?[ \t]*\n?[ \t]*`+
+		`(?:(?<=`+plSpace+`)["(](.+?)[")][ \t]*)?(?:\n+|\Z)`, plM)
+
+func (p *markdownPL) stripLinkDefinitions(text string) string {
+	for {
+		m, err := plLinkDefinition.FindStringMatch(text)
+		if err != nil || m == nil {
+			return text
+		}
+		rs := []rune(text)
+		text = string(rs[:m.Index]) + string(rs[m.Index+m.Length:])
+
+		id := plLower(plGroupString(*m, 1))
+		p.urls[id] = plEncodeAmpsAndAngles(plGroupString(*m, 2))
+		// Perl's if ($3): neither empty nor "0".
+		if title := plGroupString(*m, 3); title != "" && title != "0" {
+			p.titles[id] = strings.Replace(title, `"`, "&quot;", -1)
+		}
+	}
+}
+
+const (
+	plBlockTagsA = `p|div|h[1-6]|blockquote|pre|table|dl|ol|ul|script|noscript|form|fieldset|iframe|math|ins|del`
+	plBlockTagsB = `p|div|h[1-6]|blockquote|pre|table|dl|ol|ul|script|noscript|form|fieldset|iframe|math`
+)
+
+var (
+	plNestedHTMLBlock = plRe(`(^<((?:`+plBlockTagsA+`))`+plWordEnd+`(.*\n)*?</\2>[ \t]*(?=\n+|\Z))`, plM)
+	plHTMLBlock       = plRe(`(^<((?:`+plBlockTagsB+`))`+plWordEnd+`(.*\n)*?.*</\2>[ \t]*(?=\n+|\Z))`, plM)
+	plHRBlock         = plRe(`(?:(?<=\n\n)|\A\n?)([ ]{0,3}<(hr)`+plWordEnd+`([^<>])*?/?>[ \t]*(?=\n{2,}|\Z))`, 0)
+	plCommentBlock    = plRe(`(?:(?<=\n\n)|\A\n?)([ ]{0,3}(?s:<!(--.*?--`+plSpace+`*)+>)[ \t]*(?=\n{2,}|\Z))`, 0)
+)
+
+func (p *markdownPL) hashHTMLBlocks(text string) string {
+	hash := func(m regexp2.Match) string {
+		block := plGroupString(m, 1)
+		key := md5Hex(block)
+		p.htmlBlocks[key] = block
+		return "\n\n" + key + "\n\n"
+	}
+	text = plSubst(plNestedHTMLBlock, text, hash)
+	text = plSubst(plHTMLBlock, text, hash)
+	text = plSubst(plHRBlock, text, hash)
+	text = plSubst(plCommentBlock, text, hash)
+	return text
+}
+
+var (
+	plHRStars       = plRe(`^[ ]{0,2}([ ]?\*[ ]?){3,}[ \t]*$`, plM)
+	plHRDashes      = plRe(`^[ ]{0,2}([ ]?-[ ]?){3,}[ \t]*$`, plM)
+	plHRUnderscores = plRe(`^[ ]{0,2}([ ]?_[ ]?){3,}[ \t]*$`, plM)
+)
+
+func (p *markdownPL) runBlockGamut(text string) string {
+	text = p.doHeaders(text)
+
+	hr := plLiteral("\n<hr" + plEmptySuffix + "\n")
+	text = plSubst(plHRStars, text, hr)
+	text = plSubst(plHRDashes, text, hr)
+	text = plSubst(plHRUnderscores, text, hr)
+
+	text = p.doLists(text)
+	text = p.doCodeBlocks(text)
+	text = p.doBlockQuotes(text)
+	text = p.hashHTMLBlocks(text)
+	return p.formParagraphs(text)
+}
+
+var plHardBreak = plRe(` {2,}\n`, 0)
+
+func (p *markdownPL) runSpanGamut(text string) string {
+	text = plDoCodeSpans(text)
+	text = plEscapeSpecialChars(text)
+	text = p.doImages(text)
+	text = p.doAnchors(text)
+	text = plDoAutoLinks(text)
+	text = plEncodeAmpsAndAngles(text)
+	text = plDoItalicsAndBold(text)
+	return plSubst(plHardBreak, text, plLiteral(" <br"+plEmptySuffix+"\n"))
+}
+
+func plEscapeSpecialChars(text string) string {
+	var out strings.Builder
+	for _, t := range plTokenizeHTML(text) {
+		if t.tag {
+			out.WriteString(plEmphasisEncoder.Replace(t.s))
+		} else {
+			out.WriteString(plEncodeBackslashEscapes(t.s))
+		}
+	}
+	return out.String()
+}
+
+var (
+	plRefAnchor = plRe(
+		`(\[(`+plNestedBrackets+`)\][ ]?(?:\n[ ]*)?\[(.*?)\])`, plS)
+	plInlineAnchor = plRe(
+		`(\[(`+plNestedBrackets+`)\]\([ \t]*<?(.*?)>?[ \t]*((['"])(.*?)\5)?\))`, plS)
+)
+
+func (p *markdownPL) doAnchors(text string) string {
+	text = plSubst(plRefAnchor, text, func(m regexp2.Match) string {
+		linkText := plGroupString(m, 2)
+		id := plLower(plGroupString(m, 3))
+		if id == "" {
+			id = plLower(linkText)
+		}
+		url, ok := p.urls[id]
+		if !ok {
+			return plGroupString(m, 1)
+		}
+		result := `<a href="` + plEmphasisEncoder.Replace(url) + `"`
+		if title, ok := p.titles[id]; ok {
+			result += ` title="` + plEmphasisEncoder.Replace(title) + `"`
+		}
+		return result + ">" + linkText + "</a>"
+	})
+
+	return plSubst(plInlineAnchor, text, func(m regexp2.Match) string {
+		result := `<a href="` + plEmphasisEncoder.Replace(plGroupString(m, 3)) + `"`
+		if title, ok := plGroup(m, 6); ok {
+			title = strings.Replace(title, `"`, "&quot;", -1)
+			result += ` title="` + plEmphasisEncoder.Replace(title) + `"`
+		}
+		return result + ">" + plGroupString(m, 2) + "</a>"
+	})
+}
+
+var (
+	plRefImage = plRe(
+		`(!\[(.*?)\][ ]?(?:\n[ ]*)?\[(.*?)\])`, plS)
+	plInlineImage = plRe(
+		`(!\[(.*?)\]\([ \t]*<?(`+plNonSpace+`+?)>?[ \t]*((['"])(.*?)\5[ \t]*)?\))`, plS)
+)
+
+func (p *markdownPL) doImages(text string) string {
+	text = plSubst(plRefImage, text, func(m regexp2.Match) string {
+		alt := plGroupString(m, 2)
+		id := plLower(plGroupString(m, 3))
+		if id == "" {
+			id = plLower(alt)
+		}
+		alt = strings.Replace(alt, `"`, "&quot;", -1)
+		url, ok := p.urls[id]
+		if !ok {
+			return plGroupString(m, 1)
+		}
+		result := `<img src="` + plEmphasisEncoder.Replace(url) + `" alt="` + alt + `"`
+		if title, ok := p.titles[id]; ok {
+			result += ` title="` + plEmphasisEncoder.Replace(title) + `"`
+		}
+		return result + plEmptySuffix
+	})
+
+	return plSubst(plInlineImage, text, func(m regexp2.Match) string {
+		alt := strings.Replace(plGroupString(m, 2), `"`, "&quot;", -1)
+		// Markdown.pl defaults the title to '' and then tests it with
+		// defined, so every inline image gets a title attribute.
+		title := strings.Replace(plGroupString(m, 6), `"`, "&quot;", -1)
+		return `<img src="` + plEmphasisEncoder.Replace(plGroupString(m, 3)) + `" alt="` + alt + `"` +
+			` title="` + plEmphasisEncoder.Replace(title) + `"` + plEmptySuffix
+	})
+}
+
+var (
+	plSetextH1 = plRe(`^(.+)[ \t]*\n=+[ \t]*\n+`, plM)
+	plSetextH2 = plRe(`^(.+)[ \t]*\n-+[ \t]*\n+`, plM)
+	plAtxH     = plRe(`^(#{1,6})[ \t]*(.+?)[ \t]*#*\n+`, plM)
+)
+
+func (p *markdownPL) doHeaders(text string) string {
+	text = plSubst(plSetextH1, text, func(m regexp2.Match) string {
+		return "<h1>" + p.runSpanGamut(plGroupString(m, 1)) + "</h1>\n\n"
+	})
+	text = plSubst(plSetextH2, text, func(m regexp2.Match) string {
+		return "<h2>" + p.runSpanGamut(plGroupString(m, 1)) + "</h2>\n\n"
+	})
+	return plSubst(plAtxH, text, func(m regexp2.Match) string {
+		level := strconv.Itoa(len(plGroupString(m, 1)))
+		return "<h" + level + ">" + p.runSpanGamut(plGroupString(m, 2)) + "</h" + level + ">\n\n"
+	})
+}
+
+const (
+	plMarkerUL  = `[*+-]`
+	plMarkerOL  = `[0-9]+[.]`
+	plMarkerAny = `(?:` + plMarkerUL + `|` + plMarkerOL + `)`
+
+	plWholeList = `(([ ]{0,3}(` + plMarkerAny + `)[ \t]+)(?s:.+?)(\z|\n{2,}(?=` + plNonSpace + `)(?![ \t]*` + plMarkerAny + `[ \t]+)))`
+)
+
+var (
+	plNestedList   = plRe(`^`+plWholeList, plM)
+	plTopLevelList = plRe(`(?:(?<=\n\n)|\A\n?)`+plWholeList, plM)
+	plIsMarkerUL   = plRe(plMarkerUL, 0)
+	plBlankLines   = plRe(`\n{2,}`, 0)
+)
+
+func (p *markdownPL) doLists(text string) string {
+	re := plTopLevelList
+	if p.listLevel > 0 {
+		re = plNestedList
+	}
+	return plSubst(re, text, func(m regexp2.Match) string {
+		list := plGroupString(m, 1)
+		listType := "ol"
+		if ok, _ := plIsMarkerUL.MatchString(plGroupString(m, 3)); ok {
+			listType = "ul"
+		}
+		list = plSubst(plBlankLines, list, plLiteral("\n\n\n"))
+		result := p.processListItems(list)
+		return "<" + listType + ">\n" + result + "</" + listType + ">\n"
+	})
+}
+
+var (
+	plTrailingBlankLines = plRe(`\n{2,}\z`, 0)
+	plListItem           = plRe(
+		`(\n)?(^[ \t]*)(`+plMarkerAny+`)[ \t]+((?s:.+?)(\n{1,2}))(?=\n*(\z|\2(`+plMarkerAny+`)[ \t]+))`, plM)
+	plDoubleNewline = plRe(`\n{2,}`, 0)
+)
+
+func (p *markdownPL) processListItems(list string) string {
+	p.listLevel++
+	list = plSubstOnce(plTrailingBlankLines, list, plLiteral("\n"))
+	list = plSubst(plListItem, list, func(m regexp2.Match) string {
+		item := plGroupString(m, 4)
+		leadingLine := plGroupString(m, 1)
+		if double, _ := plDoubleNewline.MatchString(item); leadingLine != "" || double {
+			item = p.runBlockGamut(plOutdent(item))
+		} else {
+			item = p.doLists(plOutdent(item))
+			item = strings.TrimSuffix(item, "\n")
+			item = p.runSpanGamut(item)
+		}
+		return "<li>" + item + "</li>\n"
+	})
+	p.listLevel--
+	return list
+}
+
+var (
+	plCodeBlock = plRe(
+		`(?:\n\n|\A)((?:(?:[ ]{4}|\t).*\n+)+)((?=^[ ]{0,4}`+plNonSpace+`)|\Z)`, plM)
+	plLeadingNewlines    = plRe(`\A\n+`, 0)
+	plTrailingWhitespace = plRe(plSpace+`+\z`, 0)
+)
+
+func (p *markdownPL) doCodeBlocks(text string) string {
+	return plSubst(plCodeBlock, text, func(m regexp2.Match) string {
+		code := plCodeEncoder.Replace(plOutdent(plGroupString(m, 1)))
+		code = plDetab(code)
+		code = plSubstOnce(plLeadingNewlines, code, plLiteral(""))
+		code = plSubstOnce(plTrailingWhitespace, code, plLiteral(""))
+		return "\n\n<pre><code>" + code + "\n</code></pre>\n\n"
+	})
+}
+
+var (
+	plCodeSpan          = plRe("(`+)(.+?)(?<!`)\\1(?!`)", plS)
+	plLeadingSpaceTabs  = plRe(`^[ \t]*`, 0)
+	plTrailingSpaceTabs = plRe(`[ \t]*$`, 0)
+)
+
+func plDoCodeSpans(text string) string {
+	return plSubst(plCodeSpan, text, func(m regexp2.Match) string {
+		c := plGroupString(m, 2)
+		c = plSubst(plLeadingSpaceTabs, c, plLiteral(""))
+		c = plSubst(plTrailingSpaceTabs, c, plLiteral(""))
+		return "<code>" + plCodeEncoder.Replace(c) + "</code>"
+	})
+}
+
+var (
+	plStrong = plRe(`(\*\*|__)(?=`+plNonSpace+`)(.+?[*_]*)(?<=`+plNonSpace+`)\1`, plS)
+	plEm     = plRe(`(\*|_)(?=`+plNonSpace+`)(.+?)(?<=`+plNonSpace+`)\1`, plS)
+)
+
+func plDoItalicsAndBold(text string) string {
+	text = plSubst(plStrong, text, func(m regexp2.Match) string {
+		return "<strong>" + plGroupString(m, 2) + "</strong>"
+	})
+	return plSubst(plEm, text, func(m regexp2.Match) string {
+		return "<em>" + plGroupString(m, 2) + "</em>"
+	})
+}
+
+var (
+	plBlockQuote  = plRe(`((^[ \t]*>[ \t]?.+\n(.+\n)*\n*)+)`, plM)
+	plQuoteMarker = plRe(`^[ \t]*>[ \t]?`, plM)
+	plStringStart = plRe(`^`, 0)
+	plPreInQuote  = plRe(`(`+plSpace+`*<pre>.+?</pre>)`, plS)
+	plQuoteIndent = plRe(`^  `, plM)
+)
+
+func (p *markdownPL) doBlockQuotes(text string) string {
+	return plSubst(plBlockQuote, text, func(m regexp2.Match) string {
+		bq := plGroupString(m, 1)
+		bq = plSubst(plQuoteMarker, bq, plLiteral(""))
+		bq = plSubst(plBlankLine, bq, plLiteral(""))
+		bq = p.runBlockGamut(bq)
+		// s/^/  /g without /m: only the first line is indented.
+		bq = plSubst(plStringStart, bq, plLiteral("  "))
+		bq = plSubst(plPreInQuote, bq, func(m regexp2.Match) string {
+			return plSubst(plQuoteIndent, plGroupString(m, 1), plLiteral(""))
+		})
+		return "<blockquote>\n" + bq + "\n</blockquote>\n\n"
+	})
+}
+
+var (
+	plTrailingNewlines = plRe(`\n+\z`, 0)
+	plParagraphIndent  = plRe(`^([ \t]*)`, 0)
+)
+
+func (p *markdownPL) formParagraphs(text string) string {
+	text = plSubstOnce(plLeadingNewlines, text, plLiteral(""))
+	text = plSubstOnce(plTrailingNewlines, text, plLiteral(""))
+
+	grafs := plSplit(plBlankLines, text)
+	for i, g := range grafs {
+		if _, ok := p.htmlBlocks[g]; !ok {
+			g = p.runSpanGamut(g)
+			grafs[i] = plSubstOnce(plParagraphIndent, g, plLiteral("<p>")) + "</p>"
+		}
+	}
+	for i, g := range grafs {
+		if block, ok := p.htmlBlocks[g]; ok {
+			grafs[i] = block
+		}
+	}
+	return strings.Join(grafs, "\n\n")
+}
+
+// plSplit is Perl's split, which drops trailing empty fields.
+func plSplit(re *regexp2.Regexp, s string) []string {
+	var fields []string
+	rs := []rune(s)
+	start := 0
+	m, _ := re.FindStringMatch(s)
+	for m != nil {
+		fields = append(fields, string(rs[start:m.Index]))
+		start = m.Index + m.Length
+		m, _ = re.FindNextMatch(m)
+	}
+	fields = append(fields, string(rs[start:]))
+	for len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return fields
+}
+
+var (
+	plNakedAmp   = plRe(`&(?!#?[xX]?(?:[0-9a-fA-F]+|`+plWord+`+);)`, 0)
+	plNakedAngle = plRe(`<(?![a-zA-Z/?$!])`, 0)
+)
+
+func plEncodeAmpsAndAngles(text string) string {
+	text = plSubst(plNakedAmp, text, plLiteral("&amp;"))
+	return plSubst(plNakedAngle, text, plLiteral("&lt;"))
+}
+
+func plEncodeBackslashEscapes(text string) string {
+	for i := 0; i < len(plBackslashEscapes); i += 2 {
+		text = strings.Replace(text, plBackslashEscapes[i], plBackslashEscapes[i+1], -1)
+	}
+	return text
+}
+
+var (
+	plAutoLink  = plRe(`<((?i:https?|ftp):[^'"> \t\n\x0B\f\r]+)>`, 0)
+	plEmailLink = plRe(`<(?:(?i:mailto):)?([-.0-9A-Za-z_]+@(?i:[-a-z0-9]+(\.[-a-z0-9]+)*\.[a-z]+))>`, 0)
+	plMailtoTag = plRe(`">.+?:`, 0)
+)
+
+func plDoAutoLinks(text string) string {
+	text = plSubst(plAutoLink, text, func(m regexp2.Match) string {
+		url := plGroupString(m, 1)
+		return `<a href="` + url + `">` + url + "</a>"
+	})
+	return plSubst(plEmailLink, text, func(m regexp2.Match) string {
+		return plEncodeEmailAddress(plUnescapeSpecialChars.Replace(plGroupString(m, 1)))
+	})
+}
+
+// plEncodeEmailAddress writes every character of the mailto: link but the
+// colon as a decimal entity. Markdown.pl mixes decimal, hex and raw at
+// random; this is one of the outputs it can produce.
+func plEncodeEmailAddress(addr string) string {
+	var enc strings.Builder
+	for _, c := range "mailto:" + addr {
+		if c == ':' {
+			enc.WriteRune(c)
+			continue
+		}
+		enc.WriteString("&#" + strconv.Itoa(int(c)) + ";")
+	}
+	link := `<a href="` + enc.String() + `">` + enc.String() + "</a>"
+	return plSubstOnce(plMailtoTag, link, plLiteral(`">`))
+}
+
+type plToken struct {
+	tag bool
+	s   string
+}
+
+var plHTMLToken = plRe(
+	`((?s:<!(--.*?--`+plSpace+`*)+>)|(?s:<\?.*?\?>)|`+plNestedTags(6)+`)`, 0)
+
+// plNestedTags is _TokenizeHTML's $nested_tags.
+func plNestedTags(depth int) string {
+	open := `(?:<[a-zA-Z/!$](?:[^<>]`
+	return strings.TrimSuffix(strings.Repeat(open+"|", depth), "|") + strings.Repeat(`)*>)`, depth)
+}
+
+func plTokenizeHTML(s string) []plToken {
+	var tokens []plToken
+	rs := []rune(s)
+	pos := 0
+	m, _ := plHTMLToken.FindStringMatch(s)
+	for m != nil {
+		if pos < m.Index {
+			tokens = append(tokens, plToken{false, string(rs[pos:m.Index])})
+		}
+		tokens = append(tokens, plToken{true, m.String()})
+		pos = m.Index + m.Length
+		m, _ = plHTMLToken.FindNextMatch(m)
+	}
+	if pos < len(rs) {
+		tokens = append(tokens, plToken{false, string(rs[pos:])})
+	}
+	return tokens
+}
+
+var plIndent = plRe(`^(\t|[ ]{1,4})`, plM)
+
+func plOutdent(text string) string {
+	return plSubst(plIndent, text, plLiteral(""))
+}
+
+var plTab = plRe(`(.*?)\t`, 0)
+
+// plDetab expands tabs as Markdown.pl does: to the next multiple of four
+// counted from the previous tab, not from the start of the line.
+func plDetab(text string) string {
+	return plSubst(plTab, text, func(m regexp2.Match) string {
+		before := plGroupString(m, 1)
+		return before + strings.Repeat(" ", plTabWidth-len([]rune(before))%plTabWidth)
+	})
+}
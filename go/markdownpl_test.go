@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/markdownpl holds Markdown with the HTML bin/markdown makes of
+// it; update.sh there regenerates the HTML.
+func TestMarkdownPLMatchesGolden(t *testing.T) {
+	mds, err := filepath.Glob("testdata/markdownpl/*.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mds) == 0 {
+		t.Fatal("no golden files")
+	}
+	r := &markdownPLRenderer{}
+	for _, md := range mds {
+		in, err := ioutil.ReadFile(md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadFile(strings.TrimSuffix(md, ".md") + ".html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.render(in); !bytes.Equal(got, want) {
+			t.Errorf("%s:\ngot\n%s\nwant\n%s", md, got, want)
+		}
+	}
+}
+
+// Markdown.pl hides email addresses behind randomly chosen entities, so
+// they are compared once decoded.
+func TestMarkdownPLEmailAutolink(t *testing.T) {
+	r := &markdownPLRenderer{}
+	got := html.UnescapeString(string(r.render([]byte("<foo@bar.example>\n"))))
+	if want := "<p><a href=\"mailto:foo@bar.example\">foo@bar.example</a></p>\n"; got != want {
+		t.Errorf("render = %q, want %q once unescaped", got, want)
+	}
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The "memory" storage: every repository, the index and the login
+// throttle counters live in maps in this process and are gone when it
+// exits. Sessions are kept in cookies instead of memcache.
+
+func memNow() string {
+	return time.Now().Format(dbTimeLayout)
+}
+
+type memUsers struct {
+	mu     sync.RWMutex
+	users  map[int]*User
+	byName map[string]int
+	tokens map[int]*memToken
+	lastId int
+	// lastTokenId is separate, as in the api_tokens table
+	lastTokenId int
+}
+
+type memToken struct {
+	APIToken
+	hash string
+}
+
+func newMemUsers() *memUsers {
+	return &memUsers{
+		users:  make(map[int]*User),
+		byName: make(map[string]int),
+		tokens: make(map[int]*memToken),
+	}
+}
+
+// usernameKey folds case like the utf8_general_ci users_username_idx does.
+func usernameKey(username string) string {
+	return strings.ToLower(username)
+}
+
+func (s *memUsers) User(id int) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if u, found := s.users[id]; found {
+		copied := *u
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (s *memUsers) UserByName(username string) (*User, error) {
+	s.mu.RLock()
+	id, found := s.byName[usernameKey(username)]
+	s.mu.RUnlock()
+	if !found {
+		return nil, nil
+	}
+	return s.User(id)
+}
+
+func (s *memUsers) Users() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		copied := *u
+		users = append(users, &copied)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
+}
+
+func (s *memUsers) CreateUser(username, encodedPassword string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := usernameKey(username)
+	if _, found := s.byName[key]; found {
+		return 0, errUsernameTaken
+	}
+	s.lastId++
+	s.users[s.lastId] = &User{Id: s.lastId, Username: username, Password: encodedPassword, LastAccess: memNow()}
+	s.byName[key] = s.lastId
+	return s.lastId, nil
+}
+
+func (s *memUsers) SetPassword(id int, encodedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, found := s.users[id]; found {
+		u.Password, u.Salt = encodedPassword, ""
+	}
+	return nil
+}
+
+func (s *memUsers) TouchUser(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, found := s.users[id]; found {
+		u.LastAccess = memNow()
+	}
+	return nil
+}
+
+func (s *memUsers) CreateToken(userId int, name, tokenHash, scope string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastTokenId++
+	s.tokens[s.lastTokenId] = &memToken{
+		APIToken: APIToken{Id: s.lastTokenId, User: userId, Name: name, Scope: scope, CreatedAt: memNow()},
+		hash:     tokenHash,
+	}
+	return nil
+}
+
+func (s *memUsers) TokenUser(tokenHash string) (*APIToken, *User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tokens {
+		if t.hash != tokenHash {
+			continue
+		}
+		u, found := s.users[t.User]
+		if !found {
+			return nil, nil, nil
+		}
+		token, user := t.APIToken, *u
+		return &token, &user, nil
+	}
+	return nil, nil, nil
+}
+
+func (s *memUsers) TouchToken(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, found := s.tokens[id]; found {
+		t.LastUsedAt = sql.NullString{String: memNow(), Valid: true}
+	}
+	return nil
+}
+
+func (s *memUsers) Tokens(userId int) ([]*APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := make([]*APIToken, 0)
+	for _, t := range s.tokens {
+		if t.User == userId {
+			token := t.APIToken
+			tokens = append(tokens, &token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Id < tokens[j].Id })
+	return tokens, nil
+}
+
+func (s *memUsers) RevokeToken(id, userId int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, found := s.tokens[id]; found && t.User == userId {
+		delete(s.tokens, id)
+		return true, nil
+	}
+	return false, nil
+}
+
+type memMemos struct {
+	mu     sync.RWMutex
+	memos  map[int]*Memo
+	lastId int
+}
+
+func newMemMemos() *memMemos {
+	return &memMemos{memos: make(map[int]*Memo)}
+}
+
+// copyMemo returns a copy of m for a caller to modify, with Tags only when
+// withTags is set.
+func copyMemo(m *Memo, withTags bool) *Memo {
+	copied := *m
+	copied.Tags = nil
+	if withTags {
+		copied.Tags = append(make([]string, 0, len(m.Tags)), m.Tags...)
+	}
+	return &copied
+}
+
+func (s *memMemos) Memo(id int) (*Memo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if m, found := s.memos[id]; found && m.DeletedAt == "" {
+		return copyMemo(m, true), nil
+	}
+	return nil, nil
+}
+
+func (s *memMemos) Memos(ids []int) (Memos, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	memos := make(Memos, 0, len(ids))
+	for _, id := range ids {
+		if m, found := s.memos[id]; found && m.DeletedAt == "" {
+			memos = append(memos, copyMemo(m, false))
+		}
+	}
+	return memos, nil
+}
+
+// filter returns copies of the memos keep accepts, in id order.
+func (s *memMemos) filter(withTags bool, keep func(*Memo) bool) Memos {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	memos := make(Memos, 0)
+	for _, m := range s.memos {
+		if keep(m) {
+			memos = append(memos, copyMemo(m, withTags))
+		}
+	}
+	sort.Slice(memos, func(i, j int) bool { return memos[i].Id < memos[j].Id })
+	return memos
+}
+
+func (s *memMemos) PublicMemosOf(userId int) (Memos, error) {
+	return s.filter(false, func(m *Memo) bool {
+		return m.User == userId && m.IsPrivate == 0 && m.DeletedAt == ""
+	}), nil
+}
+
+func (s *memMemos) CreateMemo(memo *Memo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastId++
+	memo.Id = s.lastId
+	memo.CreatedAt = memNow()
+	memo.UpdatedAt = memo.CreatedAt
+	memo.DeletedAt = ""
+	stored := copyMemo(memo, true)
+	stored.Username = ""
+	s.memos[memo.Id] = stored
+	return nil
+}
+
+func (s *memMemos) UpdateMemo(memo *Memo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, found := s.memos[memo.Id]; found {
+		m.Content = memo.Content
+		m.IsPrivate = memo.IsPrivate
+		m.Tags = append(make([]string, 0, len(memo.Tags)), memo.Tags...)
+		m.UpdatedAt = memNow()
+	}
+	return nil
+}
+
+func (s *memMemos) Scan(batchSize int, fn func(Memos) error) error {
+	memos := s.filter(true, func(m *Memo) bool { return m.DeletedAt == "" })
+	for len(memos) > 0 {
+		n := batchSize
+		if n > len(memos) {
+			n = len(memos)
+		}
+		if err := fn(memos[:n]); err != nil {
+			return err
+		}
+		memos = memos[n:]
+	}
+	return nil
+}
+
+func (s *memMemos) TrashMemo(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, found := s.memos[id]; found && m.DeletedAt == "" {
+		m.DeletedAt = memNow()
+	}
+	return nil
+}
+
+func (s *memMemos) TrashedMemo(id, userId int) (*Memo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if m, found := s.memos[id]; found && m.User == userId && m.DeletedAt != "" {
+		return copyMemo(m, true), nil
+	}
+	return nil, nil
+}
+
+func (s *memMemos) TrashedMemos(userId int) (Memos, error) {
+	memos := s.filter(false, func(m *Memo) bool {
+		return m.User == userId && m.DeletedAt != ""
+	})
+	sort.SliceStable(memos, func(i, j int) bool { return memos[i].DeletedAt > memos[j].DeletedAt })
+	return memos, nil
+}
+
+func (s *memMemos) RestoreMemo(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, found := s.memos[id]; found {
+		m.DeletedAt = ""
+	}
+	return nil
+}
+
+func (s *memMemos) PurgeMemo(id, userId int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, found := s.memos[id]; found && m.User == userId && m.DeletedAt != "" {
+		delete(s.memos, id)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *memMemos) PurgeTrash(retention time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-retention)
+	var n int64
+	for id, m := range s.memos {
+		if m.DeletedAt != "" && parseDBTime(m.DeletedAt).Before(cutoff) {
+			delete(s.memos, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// memIndex is the MemoIndex of the memory storage, with the same lists
+// and sets as redisIndex.
+type memIndex struct {
+	mu           sync.RWMutex
+	public       []int
+	userPublic   map[int][]int
+	userMemos    map[int][]int
+	tagPublic    map[string]map[int]bool
+	userTags     map[int]map[string]map[int]bool
+	tagCloud     map[string]int
+	userTagCloud map[int]map[string]int
+	grams        map[string]map[int]bool
+	updated      time.Time
+	userUpdated  map[int]time.Time
+	migrated     bool
+}
+
+func newMemIndex() *memIndex {
+	x := &memIndex{}
+	x.reset()
+	// an empty index matches an empty repository
+	x.migrated = true
+	return x
+}
+
+func (x *memIndex) reset() {
+	x.public = nil
+	x.userPublic = make(map[int][]int)
+	x.userMemos = make(map[int][]int)
+	x.tagPublic = make(map[string]map[int]bool)
+	x.userTags = make(map[int]map[string]map[int]bool)
+	x.tagCloud = make(map[string]int)
+	x.userTagCloud = make(map[int]map[string]int)
+	x.grams = make(map[string]map[int]bool)
+	x.updated = time.Time{}
+	x.userUpdated = make(map[int]time.Time)
+	x.migrated = false
+}
+
+// page returns ids[offset:offset+limit], clipped, as a copy.
+func page(ids []int, offset, limit int) []int {
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	end := offset + limit
+	if limit < 0 || end > len(ids) {
+		end = len(ids)
+	}
+	return append(make([]int, 0, end-offset), ids[offset:end]...)
+}
+
+// insertId puts id into ids in id order, newest or oldest first.
+func insertId(ids []int, id int, newestFirst bool) []int {
+	i := sort.Search(len(ids), func(i int) bool {
+		if newestFirst {
+			return ids[i] <= id
+		}
+		return ids[i] >= id
+	})
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+// mergeIds adds ids to sorted, in id order newest or oldest first, with
+// one sort for the lot rather than an insert apiece.
+func mergeIds(sorted, ids []int, newestFirst bool) []int {
+	if len(ids) == 1 {
+		return insertId(sorted, ids[0], newestFirst)
+	}
+	merged := append(sorted, ids...)
+	if newestFirst {
+		sort.Sort(sort.Reverse(sort.IntSlice(merged)))
+	} else {
+		sort.Ints(merged)
+	}
+	out := merged[:0]
+	for i, id := range merged {
+		if i == 0 || id != merged[i-1] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func removeId(ids []int, id int) []int {
+	for i, v := range ids {
+		if v == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+func sortedIds(set map[int]bool, newestFirst bool) []int {
+	ids := make([]int, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	if newestFirst {
+		sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	} else {
+		sort.Ints(ids)
+	}
+	return ids
+}
+
+// cloudOf mirrors tagCloud: the tagCloudSize biggest tags, by name.
+func cloudOf(counts map[string]int) []*TagCount {
+	cloud := make([]*TagCount, 0, len(counts))
+	for name, n := range counts {
+		cloud = append(cloud, &TagCount{Name: name, Count: n})
+	}
+	sort.Slice(cloud, func(i, j int) bool {
+		if cloud[i].Count != cloud[j].Count {
+			return cloud[i].Count > cloud[j].Count
+		}
+		return cloud[i].Name > cloud[j].Name
+	})
+	if len(cloud) > tagCloudSize {
+		cloud = cloud[:tagCloudSize]
+	}
+	sort.Sort(tagsByName(cloud))
+	return cloud
+}
+
+func (x *memIndex) PublicMemos(offset, limit int) ([]int, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return page(x.public, offset, limit), nil
+}
+
+func (x *memIndex) PublicMemoCount() (int, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.public), nil
+}
+
+func (x *memIndex) PublicUpdated() (time.Time, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.updated, nil
+}
+
+func (x *memIndex) UserPublicUpdated(userId int) (time.Time, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.userUpdated[userId], nil
+}
+
+func (x *memIndex) UserPublicMemos(userId, offset, limit int) ([]int, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return page(x.userPublic[userId], offset, limit), nil
+}
+
+func (x *memIndex) UserMemos(userId int) ([]int, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return page(x.userMemos[userId], 0, -1), nil
+}
+
+func (x *memIndex) TagMemos(tag string, offset, limit int) ([]int, int, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	ids := sortedIds(x.tagPublic[tag], true)
+	return page(ids, offset, limit), len(ids), nil
+}
+
+func (x *memIndex) UserTagMemos(userId int, tag string) ([]int, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return sortedIds(x.userTags[userId][tag], false), nil
+}
+
+func (x *memIndex) TagCloud() ([]*TagCount, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return cloudOf(x.tagCloud), nil
+}
+
+func (x *memIndex) UserTagCloud(userId int) ([]*TagCount, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return cloudOf(x.userTagCloud[userId]), nil
+}
+
+func (x *memIndex) Search(grams []string) ([]int, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	ids := make([]int, 0)
+	if len(grams) == 0 {
+		return ids, nil
+	}
+	for id := range x.grams[grams[0]] {
+		all := true
+		for _, g := range grams[1:] {
+			if !x.grams[g][id] {
+				all = false
+				break
+			}
+		}
+		if all {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (x *memIndex) indexContent(memo *Memo) {
+	for _, g := range indexGrams(memo.Content) {
+		if x.grams[g] == nil {
+			x.grams[g] = make(map[int]bool)
+		}
+		x.grams[g][memo.Id] = true
+	}
+}
+
+func (x *memIndex) unindexContent(memo *Memo) {
+	for _, g := range indexGrams(memo.Content) {
+		delete(x.grams[g], memo.Id)
+		if len(x.grams[g]) == 0 {
+			delete(x.grams, g)
+		}
+	}
+}
+
+func (x *memIndex) indexTags(memo *Memo) {
+	if len(memo.Tags) > 0 && x.userTags[memo.User] == nil {
+		x.userTags[memo.User] = make(map[string]map[int]bool)
+		x.userTagCloud[memo.User] = make(map[string]int)
+	}
+	for _, tag := range memo.Tags {
+		if x.userTags[memo.User][tag] == nil {
+			x.userTags[memo.User][tag] = make(map[int]bool)
+		}
+		x.userTags[memo.User][tag][memo.Id] = true
+		x.userTagCloud[memo.User][tag]++
+		if memo.IsPrivate == 0 {
+			if x.tagPublic[tag] == nil {
+				x.tagPublic[tag] = make(map[int]bool)
+			}
+			x.tagPublic[tag][memo.Id] = true
+			x.tagCloud[tag]++
+		}
+	}
+}
+
+func (x *memIndex) unindexTags(memo *Memo) {
+	for _, tag := range memo.Tags {
+		delete(x.userTags[memo.User][tag], memo.Id)
+		if x.userTagCloud[memo.User][tag]--; x.userTagCloud[memo.User][tag] <= 0 {
+			delete(x.userTagCloud[memo.User], tag)
+		}
+		if memo.IsPrivate == 0 {
+			delete(x.tagPublic[tag], memo.Id)
+			if x.tagCloud[tag]--; x.tagCloud[tag] <= 0 {
+				delete(x.tagCloud, tag)
+			}
+		}
+	}
+}
+
+func (x *memIndex) publish(memo *Memo) {
+	x.public = insertId(x.public, memo.Id, true)
+	x.userPublic[memo.User] = insertId(x.userPublic[memo.User], memo.Id, true)
+	x.touch(memo.User)
+}
+
+func (x *memIndex) unpublish(memo *Memo) {
+	x.public = removeId(x.public, memo.Id)
+	x.userPublic[memo.User] = removeId(x.userPublic[memo.User], memo.Id)
+	x.touch(memo.User)
+}
+
+func (x *memIndex) touch(userId int) {
+	x.updated = time.Now()
+	x.userUpdated[userId] = x.updated
+}
+
+func (x *memIndex) Add(memos ...*Memo) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var public []int
+	userPublic := make(map[int][]int)
+	userMemos := make(map[int][]int)
+	for _, m := range memos {
+		userMemos[m.User] = append(userMemos[m.User], m.Id)
+		if m.IsPrivate == 0 {
+			public = append(public, m.Id)
+			userPublic[m.User] = append(userPublic[m.User], m.Id)
+			x.touch(m.User)
+		}
+		x.indexContent(m)
+		x.indexTags(m)
+	}
+	if len(public) > 0 {
+		x.public = mergeIds(x.public, public, true)
+	}
+	for userId, ids := range userPublic {
+		x.userPublic[userId] = mergeIds(x.userPublic[userId], ids, true)
+	}
+	for userId, ids := range userMemos {
+		x.userMemos[userId] = mergeIds(x.userMemos[userId], ids, false)
+	}
+	return nil
+}
+
+func (x *memIndex) Restore(memo *Memo) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.userMemos[memo.User] = insertId(x.userMemos[memo.User], memo.Id, false)
+	if memo.IsPrivate == 0 {
+		x.publish(memo)
+	}
+	x.indexContent(memo)
+	x.indexTags(memo)
+	return nil
+}
+
+func (x *memIndex) Update(old, memo *Memo) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if memo.Content != old.Content {
+		x.unindexContent(old)
+		x.indexContent(memo)
+	}
+	x.unindexTags(old)
+	x.indexTags(memo)
+	if memo.IsPrivate == 1 && old.IsPrivate == 0 {
+		x.unpublish(memo)
+	} else if memo.IsPrivate == 0 && old.IsPrivate == 1 {
+		x.publish(memo)
+	} else if memo.IsPrivate == 0 {
+		x.touch(memo.User)
+	}
+	return nil
+}
+
+func (x *memIndex) Remove(memo *Memo) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.userMemos[memo.User] = removeId(x.userMemos[memo.User], memo.Id)
+	x.unindexContent(memo)
+	x.unindexTags(memo)
+	if memo.IsPrivate == 0 {
+		x.unpublish(memo)
+	}
+	return nil
+}
+
+func (x *memIndex) Reset() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.reset()
+	return nil
+}
+
+func (x *memIndex) MarkMigrated() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.migrated = true
+	return nil
+}
+
+func (x *memIndex) Migrated() (bool, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.migrated, nil
+}
+
+type memThrottleStore struct {
+	mu     sync.Mutex
+	values map[string]memThrottleValue
+}
+
+type memThrottleValue struct {
+	n       int
+	expires time.Time
+}
+
+func newMemThrottleStore() *memThrottleStore {
+	return &memThrottleStore{values: make(map[string]memThrottleValue)}
+}
+
+// get returns the live value at key, dropping it once expired.
+func (s *memThrottleStore) get(key string, now time.Time) (memThrottleValue, bool) {
+	v, found := s.values[key]
+	if found && !now.Before(v.expires) {
+		delete(s.values, key)
+		return v, false
+	}
+	return v, found
+}
+
+func (s *memThrottleStore) ttl(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if v, found := s.get(key, now); found {
+		return v.expires.Sub(now), nil
+	}
+	return 0, nil
+}
+
+func (s *memThrottleStore) incr(key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	v, found := s.get(key, now)
+	if !found {
+		v.n = 0
+	}
+	v.n++
+	v.expires = now.Add(window)
+	s.values[key] = v
+	return v.n, nil
+}
+
+func (s *memThrottleStore) set(key string, n int, d time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = memThrottleValue{n: n, expires: time.Now().Add(d)}
+	return nil
+}
+
+func (s *memThrottleStore) del(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		delete(s.values, k)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemUsersCaseInsensitive(t *testing.T) {
+	users := newMemUsers()
+	id, err := users.CreateUser("Alice", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.CreateUser("alice", "y"); err != errUsernameTaken {
+		t.Fatalf("duplicate username: %v", err)
+	}
+	u, err := users.UserByName("ALICE")
+	if err != nil || u == nil || u.Id != id || u.Username != "Alice" {
+		t.Fatalf("UserByName: %+v, %v", u, err)
+	}
+}
+
+// Every change that can alter a feed must move its time, including a memo
+// leaving it.
+func TestMemIndexPublicUpdated(t *testing.T) {
+	x := newMemIndex()
+	public := &Memo{Id: 1, User: 1, Content: "a"}
+	private := &Memo{Id: 2, User: 2, Content: "b", IsPrivate: 1}
+	edited := &Memo{Id: 1, User: 1, Content: "c"}
+	hidden := &Memo{Id: 1, User: 1, Content: "c", IsPrivate: 1}
+	tests := []struct {
+		name string
+		op   func() error
+		want bool
+	}{
+		{"add public", func() error { return x.Add(public) }, true},
+		{"add private", func() error { return x.Add(private) }, false},
+		{"edit public", func() error { return x.Update(public, edited) }, true},
+		{"make private", func() error { return x.Update(edited, hidden) }, true},
+		{"remove private", func() error { return x.Remove(hidden) }, false},
+		{"restore public", func() error { return x.Restore(edited) }, true},
+		{"remove public", func() error { return x.Remove(edited) }, true},
+	}
+	for _, tt := range tests {
+		x.updated = time.Time{}
+		x.userUpdated = make(map[int]time.Time)
+		if err := tt.op(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		all, _ := x.PublicUpdated()
+		user, _ := x.UserPublicUpdated(1)
+		if all.IsZero() == tt.want || user.IsZero() == tt.want {
+			t.Errorf("%s: PublicUpdated = %v, UserPublicUpdated = %v", tt.name, all, user)
+		}
+	}
+}
+
+func TestMemIndexAddBatches(t *testing.T) {
+	x := newMemIndex()
+	memos := func(ids ...int) []*Memo {
+		ms := make([]*Memo, 0, len(ids))
+		for _, id := range ids {
+			ms = append(ms, &Memo{Id: id, User: id % 2, Content: "memo"})
+		}
+		return ms
+	}
+	x.Add(memos(1, 2, 3, 4)...)
+	x.Add(memos(7, 5, 6, 3)...)
+	x.Add(memos(8)...)
+	if got, _ := x.PublicMemos(0, -1); !reflect.DeepEqual(got, []int{8, 7, 6, 5, 4, 3, 2, 1}) {
+		t.Errorf("PublicMemos = %v", got)
+	}
+	if got, _ := x.UserPublicMemos(1, 0, -1); !reflect.DeepEqual(got, []int{7, 5, 3, 1}) {
+		t.Errorf("UserPublicMemos = %v", got)
+	}
+	if got, _ := x.UserMemos(0); !reflect.DeepEqual(got, []int{2, 4, 6, 8}) {
+		t.Errorf("UserMemos = %v", got)
+	}
+}
+
+func TestMemThrottleStore(t *testing.T) {
+	s := newMemThrottleStore()
+	for i := 1; i <= 3; i++ {
+		if n, _ := s.incr("k", time.Minute); n != i {
+			t.Fatalf("incr #%d = %d", i, n)
+		}
+	}
+	s.set("w", 1, 10*time.Millisecond)
+	if d, _ := s.ttl("w"); d <= 0 {
+		t.Fatalf("ttl of a live key = %s", d)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if d, _ := s.ttl("w"); d != 0 {
+		t.Fatalf("ttl of an expired key = %s", d)
+	}
+	s.del("k")
+	if n, _ := s.incr("k", time.Minute); n != 1 {
+		t.Fatalf("incr after del = %d", n)
+	}
+}
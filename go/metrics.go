@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served at /metrics on the admin listener when
+// server.admin_listen is set and to loopback clients on the main one
+// otherwise. Requests are labelled with the mux route template
+// ("/memo/{memo_id}") so the label set stays bounded.
+
+type metrics struct {
+	registry     *prometheus.Registry
+	handler      http.Handler
+	requests     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	sessionStore *prometheus.HistogramVec
+	cacheLookups *prometheus.CounterVec
+
+	renderCacheEvictions prometheus.Counter
+}
+
+// newMetrics registers the collectors for app on a registry of its own.
+// The pool collectors are left out when app has no MySQL or Redis.
+func newMetrics(app *App) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "isucon_http_requests_total",
+			Help: "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "isucon_http_request_duration_seconds",
+			Help:    "HTTP request latency by route and method.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"route", "method"}),
+		sessionStore: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "isucon_session_store_duration_seconds",
+			Help:    "Memcache round trips of the session store by operation.",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+		}, []string{"op"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "isucon_cache_lookups_total",
+			Help: "Cache lookups by cache and result (hit or miss).",
+		}, []string{"cache", "result"}),
+		renderCacheEvictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "isucon_render_cache_evictions_total",
+			Help: "Renders dropped from the in-process Markdown cache to stay under render_cache.max_bytes.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.duration,
+		m.sessionStore,
+		m.cacheLookups,
+		m.renderCacheEvictions,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "isucon_render_cache_entries",
+			Help: "Renders held in the in-process Markdown cache.",
+		}, func() float64 {
+			n, _ := app.renders.stats()
+			return float64(n)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "isucon_render_cache_bytes",
+			Help: "Size of the in-process Markdown cache.",
+		}, func() float64 {
+			_, n := app.renders.stats()
+			return float64(n)
+		}),
+	)
+	if app.DB != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(app.DB, "isucon"))
+	}
+	if app.Redis != nil {
+		m.registry.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "isucon_redis_pool_active_connections",
+				Help: "Redis connections open, idle or in use.",
+			}, func() float64 { return float64(app.Redis.Stats().ActiveCount) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "isucon_redis_pool_idle_connections",
+				Help: "Redis connections idle in the pool.",
+			}, func() float64 { return float64(app.Redis.Stats().IdleCount) }),
+		)
+	}
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return m
+}
+
+func (m *metrics) observeSessionStore(op string, d time.Duration) {
+	m.sessionStore.WithLabelValues(op).Observe(d.Seconds())
+}
+
+func (m *metrics) countCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+// recordRoute is mux middleware noting the matched route template on the
+// access record, for observeRequest.
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rec := accessRecordOf(w); rec != nil {
+			if route := mux.CurrentRoute(r); route != nil {
+				rec.Route, _ = route.GetPathTemplate()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *metrics) observeRequest(rec *accessRecord) {
+	route := rec.Route
+	if route == "" {
+		route = "unmatched"
+	}
+	method := rec.Method
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+	default:
+		method = "OTHER"
+	}
+	m.requests.WithLabelValues(route, method, strconv.Itoa(rec.Status)).Inc()
+	m.duration.WithLabelValues(route, method).Observe(rec.ReqTime)
+}
+
+// AdminHandler serves /metrics and the /debug pool stats.
+func (app *App) AdminHandler() http.Handler {
+	m := http.NewServeMux()
+	m.Handle("/metrics", app.metrics.handler)
+	if app.Redis != nil {
+		m.HandleFunc("/debug/redis", app.redisPoolStatsHandler)
+	}
+	if app.DB != nil {
+		m.HandleFunc("/debug/db", app.dbStatsHandler)
+	}
+	return m
+}
+
+// localOnly hides h from clients other than loopback, for mounting the
+// admin endpoints on the public listener.
+func (app *App) localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.fromLoopback(r) {
+			notFound(w)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
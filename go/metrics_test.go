@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequestMetricsUseRouteTemplates(t *testing.T) {
+	app := newTestApp(t, nil)
+	r := mux.NewRouter()
+	r.HandleFunc("/memo/{memo_id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("memo"))
+	})
+	r.Use(recordRoute)
+	h := app.withAccessLog(r)
+
+	counter := app.metrics.requests.WithLabelValues("/memo/{memo_id}", "GET", "200")
+	before := testutil.ToFloat64(counter)
+	for _, path := range []string{"/memo/1", "/memo/2", "/nowhere"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 2 {
+		t.Errorf("requests for /memo/{memo_id} = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(app.metrics.requests.WithLabelValues("unmatched", "GET", "404")); got < 1 {
+		t.Errorf("unmatched requests = %v", got)
+	}
+}
+
+func TestAdminEndpointsLocalOnly(t *testing.T) {
+	app := newTestApp(t, nil)
+	h := app.localOnly(app.AdminHandler())
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = "203.0.113.9:4000"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("remote /metrics = %d, want 404", w.Code)
+	}
+
+	req.RemoteAddr = "127.0.0.1:4000"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+	if w.Code != http.StatusOK || !strings.Contains(string(body), "isucon_redis_pool_idle_connections") {
+		t.Errorf("local /metrics = %d %.200q", w.Code, body)
+	}
+}
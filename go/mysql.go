@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlErrDupEntry is ER_DUP_ENTRY, raised by users_username_idx.
+const mysqlErrDupEntry = 1062
+
+const (
+	userColumns = "id, username, password, salt, last_access"
+	memoColumns = "id, user, content, is_private, created_at, updated_at"
+)
+
+type mysqlUsers struct {
+	db *sql.DB
+}
+
+type mysqlMemos struct {
+	db *sql.DB
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// inTx runs fn in a transaction, committing if it returns nil and rolling
+// back otherwise.
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanUser reads a row of userColumns; last_access may be NULL.
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	var lastAccess sql.NullString
+	if err := row.Scan(&user.Id, &user.Username, &user.Password, &user.Salt, &lastAccess); err != nil {
+		return nil, err
+	}
+	user.LastAccess = lastAccess.String
+	return user, nil
+}
+
+func (s *mysqlUsers) queryUser(query string, args ...interface{}) (*User, error) {
+	user, err := scanUser(s.db.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return user, err
+}
+
+func (s *mysqlUsers) User(id int) (*User, error) {
+	return s.queryUser("SELECT "+userColumns+" FROM users WHERE id=?", id)
+}
+
+func (s *mysqlUsers) UserByName(username string) (*User, error) {
+	return s.queryUser("SELECT "+userColumns+" FROM users WHERE username=?", username)
+}
+
+func (s *mysqlUsers) Users() ([]*User, error) {
+	rows, err := s.db.Query("SELECT " + userColumns + " FROM users ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]*User, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *mysqlUsers) CreateUser(username, encodedPassword string) (int, error) {
+	result, err := s.db.Exec(
+		"INSERT INTO users (username, password, salt, last_access) VALUES (?, ?, '', now())",
+		username, encodedPassword,
+	)
+	if me, ok := err.(*mysql.MySQLError); ok && me.Number == mysqlErrDupEntry {
+		return 0, errUsernameTaken
+	}
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *mysqlUsers) SetPassword(id int, encodedPassword string) error {
+	_, err := s.db.Exec("UPDATE users SET password=?, salt='' WHERE id=?", encodedPassword, id)
+	return err
+}
+
+func (s *mysqlUsers) TouchUser(id int) error {
+	_, err := s.db.Exec("UPDATE users SET last_access=now() WHERE id=?", id)
+	return err
+}
+
+func (s *mysqlUsers) CreateToken(userId int, name, tokenHash, scope string) error {
+	_, err := s.db.Exec(
+		"INSERT INTO api_tokens (user, name, token_hash, scope, created_at) VALUES (?, ?, ?, ?, now())",
+		userId, name, tokenHash, scope,
+	)
+	return err
+}
+
+func (s *mysqlUsers) TokenUser(tokenHash string) (*APIToken, *User, error) {
+	token := &APIToken{}
+	user := &User{}
+	var lastAccess sql.NullString
+	err := s.db.QueryRow(
+		"SELECT t.id, t.user, t.name, t.scope, t.created_at, t.last_used_at, u.id, u.username, u.password, u.salt, u.last_access FROM api_tokens t JOIN users u ON u.id = t.user WHERE t.token_hash=?",
+		tokenHash,
+	).Scan(&token.Id, &token.User, &token.Name, &token.Scope, &token.CreatedAt, &token.LastUsedAt,
+		&user.Id, &user.Username, &user.Password, &user.Salt, &lastAccess)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	user.LastAccess = lastAccess.String
+	return token, user, nil
+}
+
+func (s *mysqlUsers) TouchToken(id int) error {
+	_, err := s.db.Exec("UPDATE api_tokens SET last_used_at=now() WHERE id=?", id)
+	return err
+}
+
+func (s *mysqlUsers) Tokens(userId int) ([]*APIToken, error) {
+	rows, err := s.db.Query(
+		"SELECT id, user, name, scope, created_at, last_used_at FROM api_tokens WHERE user=? ORDER BY id ASC",
+		userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]*APIToken, 0)
+	for rows.Next() {
+		t := &APIToken{}
+		if err := rows.Scan(&t.Id, &t.User, &t.Name, &t.Scope, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *mysqlUsers) RevokeToken(id, userId int) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM api_tokens WHERE id=? AND user=?", id, userId)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// queryMemos scans rows of memoColumns, plus deleted_at when trashed.
+func (s *mysqlMemos) queryMemos(trashed bool, query string, args ...interface{}) (Memos, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	memos := make(Memos, 0)
+	for rows.Next() {
+		m := &Memo{}
+		dest := []interface{}{&m.Id, &m.User, &m.Content, &m.IsPrivate, &m.CreatedAt, &m.UpdatedAt}
+		if trashed {
+			dest = append(dest, &m.DeletedAt)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		memos = append(memos, m)
+	}
+	return memos, rows.Err()
+}
+
+// withTags fills in the Tags of the first of memos, if any.
+func (s *mysqlMemos) withTags(memos Memos, err error) (*Memo, error) {
+	if err != nil || len(memos) == 0 {
+		return nil, err
+	}
+	memo := memos[0]
+	memo.Tags, err = s.tags(memo.Id)
+	return memo, err
+}
+
+func (s *mysqlMemos) Memo(id int) (*Memo, error) {
+	return s.withTags(s.queryMemos(false,
+		"SELECT "+memoColumns+" FROM memos WHERE id=? AND deleted_at IS NULL", id))
+}
+
+func (s *mysqlMemos) Memos(ids []int) (Memos, error) {
+	if len(ids) == 0 {
+		return make(Memos, 0), nil
+	}
+	memos, err := s.queryMemos(false,
+		"SELECT "+memoColumns+" FROM memos WHERE id IN ("+joinIds(ids)+") AND deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[int]*Memo, len(memos))
+	for _, m := range memos {
+		byId[m.Id] = m
+	}
+	results := make(Memos, 0, len(memos))
+	for _, id := range ids {
+		if m, found := byId[id]; found {
+			results = append(results, m)
+		}
+	}
+	return results, nil
+}
+
+func (s *mysqlMemos) PublicMemosOf(userId int) (Memos, error) {
+	return s.queryMemos(false,
+		"SELECT "+memoColumns+" FROM memos WHERE user=? AND is_private=0 AND deleted_at IS NULL ORDER BY created_at", userId)
+}
+
+func (s *mysqlMemos) CreateMemo(memo *Memo) error {
+	return inTx(s.db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			"INSERT INTO memos (user, content, is_private, created_at) VALUES (?, ?, ?, now())",
+			memo.User, memo.Content, memo.IsPrivate,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		memo.Id = int(id)
+		return saveTags(tx, memo.Id, memo.Tags)
+	})
+}
+
+func (s *mysqlMemos) UpdateMemo(memo *Memo) error {
+	return inTx(s.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"UPDATE memos SET content=?, is_private=? WHERE id=?",
+			memo.Content, memo.IsPrivate, memo.Id,
+		)
+		if err != nil {
+			return err
+		}
+		return saveTags(tx, memo.Id, memo.Tags)
+	})
+}
+
+func (s *mysqlMemos) Scan(batchSize int, fn func(Memos) error) error {
+	cursor := 0
+	for {
+		memos, err := s.queryMemos(false,
+			"SELECT "+memoColumns+" FROM memos WHERE id > ? AND deleted_at IS NULL ORDER BY id ASC LIMIT ?", cursor, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(memos) == 0 {
+			return nil
+		}
+		if err := s.batchTags(memos); err != nil {
+			return err
+		}
+		if err := fn(memos); err != nil {
+			return err
+		}
+		if len(memos) < batchSize {
+			return nil
+		}
+		cursor = memos[len(memos)-1].Id
+	}
+}
+
+func (s *mysqlMemos) TrashMemo(id int) error {
+	_, err := s.db.Exec(
+		"UPDATE memos SET deleted_at=now(), updated_at=updated_at WHERE id=? AND deleted_at IS NULL",
+		id,
+	)
+	return err
+}
+
+func (s *mysqlMemos) TrashedMemo(id, userId int) (*Memo, error) {
+	return s.withTags(s.queryMemos(true,
+		"SELECT "+memoColumns+", deleted_at FROM memos WHERE id=? AND user=? AND deleted_at IS NOT NULL", id, userId))
+}
+
+func (s *mysqlMemos) TrashedMemos(userId int) (Memos, error) {
+	return s.queryMemos(true,
+		"SELECT "+memoColumns+", deleted_at FROM memos WHERE user=? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC", userId)
+}
+
+func (s *mysqlMemos) RestoreMemo(id int) error {
+	_, err := s.db.Exec("UPDATE memos SET deleted_at=NULL, updated_at=updated_at WHERE id=?", id)
+	return err
+}
+
+func (s *mysqlMemos) PurgeMemo(id, userId int) (bool, error) {
+	var purged bool
+	err := inTx(s.db, func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM memos WHERE id=? AND user=? AND deleted_at IS NOT NULL", id, userId)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return nil
+		}
+		purged = true
+		_, err = tx.Exec("DELETE FROM memo_tags WHERE memo_id=?", id)
+		return err
+	})
+	return purged && err == nil, err
+}
+
+func (s *mysqlMemos) PurgeTrash(retention time.Duration) (int64, error) {
+	seconds := int64(retention / time.Second)
+	var purged int64
+	err := inTx(s.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"DELETE t FROM memo_tags t JOIN memos m ON m.id = t.memo_id WHERE m.deleted_at IS NOT NULL AND m.deleted_at < now() - INTERVAL ? SECOND",
+			seconds,
+		)
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec(
+			"DELETE FROM memos WHERE deleted_at IS NOT NULL AND deleted_at < now() - INTERVAL ? SECOND",
+			seconds,
+		)
+		if err != nil {
+			return err
+		}
+		purged, err = result.RowsAffected()
+		return err
+	})
+	return purged, err
+}
+
+func (s *mysqlMemos) tags(memoId int) ([]string, error) {
+	rows, err := s.db.Query("SELECT tag FROM memo_tags WHERE memo_id=? ORDER BY tag", memoId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// batchTags fills in the Tags of memos with one query.
+func (s *mysqlMemos) batchTags(memos Memos) error {
+	ids := make([]int, len(memos))
+	byId := make(map[int]*Memo, len(memos))
+	for i, m := range memos {
+		ids[i] = m.Id
+		byId[m.Id] = m
+		m.Tags = make([]string, 0)
+	}
+	rows, err := s.db.Query("SELECT memo_id, tag FROM memo_tags WHERE memo_id IN (" + joinIds(ids) + ") ORDER BY memo_id, tag")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var memoId int
+		var tag string
+		if err := rows.Scan(&memoId, &tag); err != nil {
+			return err
+		}
+		byId[memoId].Tags = append(byId[memoId].Tags, tag)
+	}
+	return rows.Err()
+}
+
+// saveTags replaces the tags of memoId within tx.
+func saveTags(tx *sql.Tx, memoId int, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM memo_tags WHERE memo_id=?", memoId); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT INTO memo_tags (memo_id, tag) VALUES (?, ?)", memoId, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinIds formats ids for an IN clause. They are ints, so there is
+// nothing to escape.
+func joinIds(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"./passwords"
+)
+
+var passwordReport = flag.Bool("password-report", false, "print how many accounts use each password scheme and exit")
+
+// PasswordHashConfig is the password_hash section of the config file.
+// Unset fields keep the passwords package defaults.
+type PasswordHashConfig struct {
+	Algorithm     string `json:"algorithm"`
+	Argon2Time    uint32 `json:"argon2_time"`
+	Argon2Memory  uint32 `json:"argon2_memory_kib"`
+	Argon2Threads uint8  `json:"argon2_threads"`
+	BcryptCost    int    `json:"bcrypt_cost"`
+	// MaxConcurrent is how many hashes are computed at once; sign-ins and
+	// sign-ups beyond it wait. With argon2id the memory they take is up
+	// to MaxConcurrent × Argon2Memory, 256 MiB with the defaults.
+	MaxConcurrent int `json:"max_concurrent"`
+}
+
+const defaultPasswordHashConcurrency = 4
+
+func newPasswordHasher(c PasswordHashConfig) (*passwords.Policy, error) {
+	p, err := newPasswordPolicy(c)
+	if err != nil {
+		return nil, err
+	}
+	n := c.MaxConcurrent
+	if n <= 0 {
+		n = defaultPasswordHashConcurrency
+	}
+	p.SetMaxConcurrent(n)
+	return p, nil
+}
+
+func newPasswordPolicy(c PasswordHashConfig) (*passwords.Policy, error) {
+	switch c.Algorithm {
+	case "", passwords.SchemeArgon2id:
+		a := passwords.DefaultArgon2id()
+		if c.Argon2Time > 0 {
+			a.Time = c.Argon2Time
+		}
+		if c.Argon2Memory > 0 {
+			a.Memory = c.Argon2Memory
+		}
+		if c.Argon2Threads > 0 {
+			a.Threads = c.Argon2Threads
+		}
+		return passwords.NewPolicy(a), nil
+	case passwords.SchemeBcrypt:
+		b := &passwords.Bcrypt{Cost: 10}
+		if c.BcryptCost > 0 {
+			b.Cost = c.BcryptCost
+		}
+		return passwords.NewPolicy(b), nil
+	}
+	return nil, fmt.Errorf("password_hash: unknown algorithm %q", c.Algorithm)
+}
+
+func (app *App) setPasswordHasher(p *passwords.Policy) error {
+	dummy, err := p.Hash("dummy password")
+	if err != nil {
+		return err
+	}
+	app.Hasher = p
+	app.dummyPasswordHash = dummy
+	return nil
+}
+
+// checkPassword verifies password for user and, when it matches a legacy
+// or outdated hash, stores a fresh hash in the current format. A nil user
+// is checked against a dummy hash and never matches. A hash that cannot
+// be read does not match either, and is logged against the request w
+// answers.
+func (app *App) checkPassword(w http.ResponseWriter, user *User, password string) (bool, error) {
+	if user == nil {
+		app.Hasher.Verify(app.dummyPasswordHash, "", password)
+		return false, nil
+	}
+	if passwords.Scheme(user.Password) == passwords.SchemeLegacy {
+		// A sha256 takes no time; pay for a hash as an unknown user does.
+		app.Hasher.Verify(app.dummyPasswordHash, "", password)
+	}
+	ok, rehash, err := app.Hasher.Verify(user.Password, user.Salt, password)
+	if err != nil {
+		logError(w, fmt.Errorf("password of user %d: %s", user.Id, err))
+		return false, nil
+	}
+	if !ok || !rehash {
+		return ok, nil
+	}
+	encoded, err := app.Hasher.Hash(password)
+	if err != nil {
+		return true, err
+	}
+	if err := app.Users.SetPassword(user.Id, encoded); err != nil {
+		return true, err
+	}
+	user.Password, user.Salt = encoded, ""
+	return true, nil
+}
+
+// reportPasswordSchemes writes the number of accounts per password scheme,
+// for -password-report.
+func reportPasswordSchemes(users UserRepository, w io.Writer) error {
+	all, err := users.Users()
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	total := 0
+	for _, u := range all {
+		counts[passwords.Scheme(u.Password)]++
+		total++
+	}
+	schemes := make([]string, 0, len(counts))
+	for s := range counts {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	for _, s := range schemes {
+		fmt.Fprintf(w, "%s\t%d\n", s, counts[s])
+	}
+	fmt.Fprintf(w, "total\t%d\n", total)
+	if total > 0 {
+		fmt.Fprintf(w, "legacy\t%.1f%%\n", float64(counts[passwords.SchemeLegacy])*100/float64(total))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"./passwords"
+)
+
+// countingHasher counts the hashes verified with it.
+type countingHasher struct {
+	passwords.Bcrypt
+	verified int
+}
+
+func (h *countingHasher) Verify(encoded, password string) (bool, error) {
+	h.verified++
+	return h.Bcrypt.Verify(encoded, password)
+}
+
+// A known username must cost a hash whatever its scheme, as an unknown one
+// does, so that timing does not tell them apart.
+func TestCheckPasswordAlwaysHashes(t *testing.T) {
+	app := newMemoryTestApp(t, nil)
+	h := &countingHasher{Bcrypt: passwords.Bcrypt{Cost: 4}}
+	if err := app.setPasswordHasher(passwords.NewPolicy(h)); err != nil {
+		t.Fatal(err)
+	}
+	current, err := h.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		user *User
+	}{
+		{"unknown", nil},
+		{"legacy", &User{Id: 1, Password: passwords.LegacyHash("salt", testPassword), Salt: "salt"}},
+		{"current", &User{Id: 2, Password: current}},
+	} {
+		h.verified = 0
+		if ok, err := app.checkPassword(httptest.NewRecorder(), tt.user, "wrong password"); ok || err != nil {
+			t.Errorf("%s: checkPassword = %v, %v", tt.name, ok, err)
+		}
+		if h.verified != 1 {
+			t.Errorf("%s: %d hashes verified, want 1", tt.name, h.verified)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Package passwords hashes and verifies the values stored in
+// users.password.
+//
+// New hashes are self-describing strings in the usual modular crypt
+// formats ("$argon2id$v=19$m=...,t=...,p=...$salt$hash", "$2a$10$..."),
+// so the algorithm and its parameters travel with the hash. The original
+// scheme, hex(sha256(salt + password)) with the salt in users.salt, can
+// still be verified so existing accounts keep working and get upgraded on
+// their next successful login.
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Scheme names as reported by Scheme.
+const (
+	SchemeLegacy   = "sha256"
+	SchemeArgon2id = "argon2id"
+	SchemeBcrypt   = "bcrypt"
+	SchemeUnknown  = "unknown"
+)
+
+var ErrMalformedHash = errors.New("passwords: malformed hash")
+
+// Hasher is one password hashing algorithm.
+type Hasher interface {
+	// Scheme is the name reported by the package-level Scheme function
+	// for hashes this Hasher produced.
+	Scheme() string
+	// Hash returns an encoded hash of password.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches encoded.
+	Verify(encoded, password string) (bool, error)
+	// NeedsRehash reports whether encoded was made with parameters other
+	// than the Hasher's current ones.
+	NeedsRehash(encoded string) bool
+}
+
+// Scheme returns the name of the scheme encoded was hashed with.
+func Scheme(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return SchemeArgon2id
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return SchemeBcrypt
+	case isLegacy(encoded):
+		return SchemeLegacy
+	}
+	return SchemeUnknown
+}
+
+// Policy hashes new passwords with Hasher and verifies hashes made by any
+// known scheme.
+type Policy struct {
+	Hasher  Hasher
+	hashers map[string]Hasher
+	// sem holds a token per hash being computed; nil means no limit.
+	sem chan struct{}
+}
+
+// NewPolicy returns a Policy hashing with current. Hashes from the other
+// built-in schemes are verified with default parameters.
+func NewPolicy(current Hasher) *Policy {
+	p := &Policy{
+		Hasher: current,
+		hashers: map[string]Hasher{
+			SchemeArgon2id: DefaultArgon2id(),
+			SchemeBcrypt:   &Bcrypt{Cost: bcrypt.DefaultCost},
+		},
+	}
+	p.hashers[current.Scheme()] = current
+	return p
+}
+
+// SetMaxConcurrent makes Hash and Verify compute at most n hashes at a
+// time, with further callers waiting their turn. Each argon2id hash holds
+// its Memory for as long as it runs, so this bounds the memory that many
+// simultaneous sign-ins can take. n <= 0 removes the limit. Call it before
+// the Policy is in use.
+func (p *Policy) SetMaxConcurrent(n int) {
+	p.sem = nil
+	if n > 0 {
+		p.sem = make(chan struct{}, n)
+	}
+}
+
+func (p *Policy) acquire() {
+	if p.sem != nil {
+		p.sem <- struct{}{}
+	}
+}
+
+func (p *Policy) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+// MaxPasswordBytes returns the longest password, in bytes, that the
+// current Hasher can hash, or 0 if there is no limit.
+func (p *Policy) MaxPasswordBytes() int {
+	if l, ok := p.Hasher.(interface{ MaxPasswordBytes() int }); ok {
+		return l.MaxPasswordBytes()
+	}
+	return 0
+}
+
+// Hash hashes password with the current Hasher.
+func (p *Policy) Hash(password string) (string, error) {
+	p.acquire()
+	defer p.release()
+	return p.Hasher.Hash(password)
+}
+
+// Verify checks password against encoded, using salt for legacy hashes.
+// rehash is true when the password matched but encoded should be replaced
+// with a fresh Hash.
+func (p *Policy) Verify(encoded, salt, password string) (ok, rehash bool, err error) {
+	scheme := Scheme(encoded)
+	if scheme == SchemeLegacy {
+		ok = subtle.ConstantTimeCompare([]byte(LegacyHash(salt, password)), []byte(strings.ToLower(encoded))) == 1
+		return ok, ok, nil
+	}
+	h, found := p.hashers[scheme]
+	if !found {
+		return false, false, ErrMalformedHash
+	}
+	p.acquire()
+	ok, err = h.Verify(encoded, password)
+	p.release()
+	if err != nil || !ok {
+		return false, false, err
+	}
+	rehash = scheme != p.Hasher.Scheme() || p.Hasher.NeedsRehash(encoded)
+	return true, rehash, nil
+}
+
+// LegacyHash is the original users.password scheme.
+func LegacyHash(salt, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func isLegacy(encoded string) bool {
+	if len(encoded) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+// Argon2id ------------------------------------------------------------------
+
+// Argon2id hashes with argon2id. Memory is in KiB.
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  uint32
+}
+
+// DefaultArgon2id returns the parameters recommended by RFC 9106 for
+// memory-constrained servers.
+func DefaultArgon2id() *Argon2id {
+	return &Argon2id{Time: 3, Memory: 64 * 1024, Threads: 4, SaltLen: 16, KeyLen: 32}
+}
+
+func (a *Argon2id) Scheme() string { return SchemeArgon2id }
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+type argon2Params struct {
+	version      int
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func parseArgon2id(encoded string) (*argon2Params, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrMalformedHash
+	}
+	p := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &p.version); err != nil {
+		return nil, ErrMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, ErrMalformedHash
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrMalformedHash
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return nil, ErrMalformedHash
+	}
+	return p, nil
+}
+
+func (a *Argon2id) Verify(encoded, password string) (bool, error) {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	if p.version != argon2.Version {
+		return false, ErrMalformedHash
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+}
+
+func (a *Argon2id) NeedsRehash(encoded string) bool {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return p.version != argon2.Version || p.memory != a.Memory || p.time != a.Time ||
+		p.threads != a.Threads || len(p.salt) != a.SaltLen || uint32(len(p.key)) != a.KeyLen
+}
+
+// Bcrypt ----------------------------------------------------------------------
+
+// Bcrypt hashes with bcrypt. Passwords longer than MaxPasswordBytes are
+// rejected by Hash.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b *Bcrypt) Scheme() string { return SchemeBcrypt }
+
+// MaxPasswordBytes is the most bcrypt reads of a password.
+func (b *Bcrypt) MaxPasswordBytes() int { return 72 }
+
+func (b *Bcrypt) Hash(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(h), err
+}
+
+func (b *Bcrypt) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
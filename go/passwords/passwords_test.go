@@ -0,0 +1,162 @@
+package passwords
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testArgon2id() *Argon2id {
+	return &Argon2id{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+}
+
+func TestLegacyHash(t *testing.T) {
+	// echo -n 'saltpassword' | sha256sum
+	want := "13601bda4ea78e55a07b98866d2be6be0744e3866f13c00c811cab608a28f322"
+	if got := LegacyHash("salt", "password"); got != want {
+		t.Fatalf("LegacyHash = %s, want %s", got, want)
+	}
+}
+
+func TestScheme(t *testing.T) {
+	tests := map[string]string{
+		LegacyHash("s", "p"):                SchemeLegacy,
+		"$argon2id$v=19$m=1024,t=1,p=1$a$b": SchemeArgon2id,
+		"$2a$10$abcdefghijklmnopqrstuv":     SchemeBcrypt,
+		"plaintext":                         SchemeUnknown,
+		strings.Repeat("z", 64):             SchemeUnknown,
+	}
+	for encoded, want := range tests {
+		if got := Scheme(encoded); got != want {
+			t.Errorf("Scheme(%q) = %s, want %s", encoded, got, want)
+		}
+	}
+}
+
+func TestPolicyVerifyLegacyRequestsRehash(t *testing.T) {
+	p := NewPolicy(testArgon2id())
+	encoded := LegacyHash("salt", "secret")
+
+	ok, rehash, err := p.Verify(encoded, "salt", "secret")
+	if err != nil || !ok || !rehash {
+		t.Fatalf("Verify legacy = %v, %v, %v; want true, true, nil", ok, rehash, err)
+	}
+	ok, rehash, err = p.Verify(encoded, "salt", "wrong")
+	if err != nil || ok || rehash {
+		t.Fatalf("Verify legacy wrong password = %v, %v, %v", ok, rehash, err)
+	}
+}
+
+func TestPolicyArgon2idRoundTrip(t *testing.T) {
+	p := NewPolicy(testArgon2id())
+	encoded, err := p.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Scheme(encoded) != SchemeArgon2id {
+		t.Fatalf("unexpected encoding %q", encoded)
+	}
+	ok, rehash, err := p.Verify(encoded, "", "secret")
+	if err != nil || !ok || rehash {
+		t.Fatalf("Verify = %v, %v, %v; want true, false, nil", ok, rehash, err)
+	}
+	if ok, _, _ := p.Verify(encoded, "", "Secret"); ok {
+		t.Fatal("wrong password accepted")
+	}
+
+	stronger := testArgon2id()
+	stronger.Time = 2
+	if _, rehash, _ := NewPolicy(stronger).Verify(encoded, "", "secret"); !rehash {
+		t.Fatal("changed parameters did not request a rehash")
+	}
+}
+
+func TestPolicyBcryptUpgradesToCurrent(t *testing.T) {
+	b := &Bcrypt{Cost: 4}
+	encoded, err := b.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, rehash, err := NewPolicy(testArgon2id()).Verify(encoded, "", "secret")
+	if err != nil || !ok || !rehash {
+		t.Fatalf("Verify bcrypt under argon2id policy = %v, %v, %v", ok, rehash, err)
+	}
+	ok, rehash, err = NewPolicy(b).Verify(encoded, "", "secret")
+	if err != nil || !ok || rehash {
+		t.Fatalf("Verify bcrypt under bcrypt policy = %v, %v, %v", ok, rehash, err)
+	}
+}
+
+func TestPolicyMaxPasswordBytes(t *testing.T) {
+	if n := NewPolicy(testArgon2id()).MaxPasswordBytes(); n != 0 {
+		t.Errorf("argon2id limit = %d", n)
+	}
+	b := NewPolicy(&Bcrypt{Cost: 4})
+	n := b.MaxPasswordBytes()
+	if _, err := b.Hash(strings.Repeat("x", n)); err != nil {
+		t.Errorf("Hash at the limit: %v", err)
+	}
+	if _, err := b.Hash(strings.Repeat("x", n+1)); err == nil {
+		t.Errorf("Hash over the limit of %d succeeded", n)
+	}
+}
+
+func TestPolicyVerifyMalformed(t *testing.T) {
+	p := NewPolicy(testArgon2id())
+	for _, encoded := range []string{"", "nope", "$argon2id$v=19$garbage"} {
+		if ok, _, err := p.Verify(encoded, "", "x"); ok || err == nil {
+			t.Errorf("Verify(%q) = %v, %v; want false and an error", encoded, ok, err)
+		}
+	}
+}
+
+// slowHasher records how many of its hashes run at once.
+type slowHasher struct {
+	running, peak int32
+}
+
+func (h *slowHasher) Scheme() string { return SchemeBcrypt }
+
+func (h *slowHasher) Hash(password string) (string, error) {
+	n := atomic.AddInt32(&h.running, 1)
+	for {
+		peak := atomic.LoadInt32(&h.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&h.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	atomic.AddInt32(&h.running, -1)
+	return "$2a$" + password, nil
+}
+
+func (h *slowHasher) Verify(encoded, password string) (bool, error) {
+	_, err := h.Hash(password)
+	return encoded == "$2a$"+password, err
+}
+
+func (h *slowHasher) NeedsRehash(string) bool { return false }
+
+func TestPolicyMaxConcurrent(t *testing.T) {
+	h := &slowHasher{}
+	p := NewPolicy(h)
+	p.SetMaxConcurrent(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			p.Hash("x")
+		}()
+		go func() {
+			defer wg.Done()
+			p.Verify("$2a$x", "", "x")
+		}()
+	}
+	wg.Wait()
+	if h.peak != 2 {
+		t.Errorf("peak concurrency = %d, want 2", h.peak)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisConfig is the redis section of the config file.
+type RedisConfig struct {
+	Addr               string `json:"addr"`
+	MaxIdle            int    `json:"max_idle"`
+	MaxActive          int    `json:"max_active"`
+	IdleTimeoutSeconds int    `json:"idle_timeout_seconds"`
+	ConnectTimeoutMs   int    `json:"connect_timeout_ms"`
+	ReadTimeoutMs      int    `json:"read_timeout_ms"`
+	WriteTimeoutMs     int    `json:"write_timeout_ms"`
+	// WaitTimeoutMs bounds the wait for a connection once MaxActive are
+	// in use.
+	WaitTimeoutMs int `json:"wait_timeout_ms"`
+}
+
+func (c RedisConfig) withDefaults() RedisConfig {
+	if c.Addr == "" {
+		c.Addr = ":6379"
+	}
+	if c.MaxIdle <= 0 {
+		c.MaxIdle = 64
+	}
+	if c.MaxActive <= 0 {
+		c.MaxActive = 256
+	}
+	if c.IdleTimeoutSeconds <= 0 {
+		c.IdleTimeoutSeconds = 240
+	}
+	if c.ConnectTimeoutMs <= 0 {
+		c.ConnectTimeoutMs = 500
+	}
+	if c.ReadTimeoutMs <= 0 {
+		c.ReadTimeoutMs = 1000
+	}
+	if c.WriteTimeoutMs <= 0 {
+		c.WriteTimeoutMs = 1000
+	}
+	if c.WaitTimeoutMs <= 0 {
+		c.WaitTimeoutMs = 1000
+	}
+	return c
+}
+
+// Idle connections are PINGed before reuse once they have sat in the pool
+// for this long.
+const redisPingAfterIdle = time.Minute
+
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+// dialRedis opens a connection for the pool. Commands that may run long,
+// such as the EXECs of redisIndex.Add, override readTimeout per call.
+func dialRedis(c RedisConfig, readTimeout time.Duration) (redis.Conn, error) {
+	return redis.Dial("tcp", c.Addr,
+		redis.DialConnectTimeout(ms(c.ConnectTimeoutMs)),
+		redis.DialReadTimeout(readTimeout),
+		redis.DialWriteTimeout(ms(c.WriteTimeoutMs)),
+	)
+}
+
+func newRedisPool(c RedisConfig) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     c.MaxIdle,
+		MaxActive:   c.MaxActive,
+		IdleTimeout: time.Duration(c.IdleTimeoutSeconds) * time.Second,
+		// Wait for a free connection rather than failing the request when
+		// MaxActive are in use; redisConn bounds how long that is.
+		Wait: true,
+		Dial: func() (redis.Conn, error) {
+			return dialRedis(c, ms(c.ReadTimeoutMs))
+		},
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < redisPingAfterIdle {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+}
+
+// redisConn borrows a connection from pool, waiting at most wait for one
+// to be free, or for as long as it takes if wait is 0. Callers must Close
+// it to give it back.
+func redisConn(pool *redis.Pool, wait time.Duration) (redis.Conn, error) {
+	ctx := context.Background()
+	if wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wait)
+		defer cancel()
+	}
+	c, err := pool.GetContext(ctx)
+	if err == context.DeadlineExceeded {
+		return nil, fmt.Errorf("redis: no free connection within %s", wait)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Err(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// redisPoolStatsHandler serves the pool counters as JSON.
+func (app *App) redisPoolStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := app.Redis.Stats()
+	debugJSON(w, map[string]interface{}{
+		"addr":         app.RedisConfig.Addr,
+		"active_count": stats.ActiveCount,
+		"idle_count":   stats.IdleCount,
+		"max_active":   app.RedisConfig.MaxActive,
+		"max_idle":     app.RedisConfig.MaxIdle,
+	})
+}
+
+// redisIndex is the MemoIndex kept in Redis:
+//
+//	public_memos                  sorted set of public memo ids, scored by id
+//	user_public_memos:{uid}       the same for a user's public memos
+//	user_memos:{uid}              the same for all of a user's memos
+//	public_memo_updated_at        unix time of the last change to a public memo
+//	user_public_memo_updated_at:{uid}  the same for a user's public memos
+//	index_migrated_at             set once Reset has been followed by MarkMigrated
+//
+// plus the tag keys of tags.go and the search keys of search.go. Scoring by
+// id keeps every set in id order however memos come and go, so each change
+// is one MULTI.
+type redisIndex struct {
+	pool *redis.Pool
+	wait time.Duration
+}
+
+// redisMigratedKey is set by MarkMigrated once the sets are built. It is
+// named apart from the migrated_at of the older index, which kept lists,
+// so a Redis holding that one reads as not migrated until /init.
+const redisMigratedKey = "index_migrated_at"
+
+func (x *redisIndex) ints(cmd string, args ...interface{}) ([]int, error) {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return redis.Ints(c.Do(cmd, args...))
+}
+
+// exec runs the commands queued by send in one MULTI/EXEC, with no read
+// timeout since a large batch can take a while.
+func (x *redisIndex) exec(send func(c redis.Conn)) error {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.Send("MULTI")
+	send(c)
+	_, err = redis.DoWithTimeout(c, 0, "EXEC")
+	return err
+}
+
+func (x *redisIndex) PublicMemos(offset, limit int) ([]int, error) {
+	return x.ints("ZREVRANGE", "public_memos", offset, offset+limit-1)
+}
+
+func (x *redisIndex) PublicMemoCount() (int, error) {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	return redis.Int(c.Do("ZCARD", "public_memos"))
+}
+
+func (x *redisIndex) UserPublicMemos(userId, offset, limit int) ([]int, error) {
+	return x.ints("ZREVRANGE", fmt.Sprintf("user_public_memos:%d", userId), offset, offset+limit-1)
+}
+
+func (x *redisIndex) UserMemos(userId int) ([]int, error) {
+	return x.ints("ZRANGE", fmt.Sprintf("user_memos:%d", userId), 0, -1)
+}
+
+func (x *redisIndex) PublicUpdated() (time.Time, error) {
+	return x.updated("public_memo_updated_at")
+}
+
+func (x *redisIndex) UserPublicUpdated(userId int) (time.Time, error) {
+	return x.updated(fmt.Sprintf("user_public_memo_updated_at:%d", userId))
+}
+
+func (x *redisIndex) updated(key string) (time.Time, error) {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer c.Close()
+	sec, err := redis.Int64(c.Do("GET", key))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// touchPublic queues the SETs that record a change to userId's public
+// memos, for PublicUpdated and UserPublicUpdated.
+func touchPublic(rdb redis.Conn, userId int) {
+	now := time.Now().Unix()
+	rdb.Send("SET", "public_memo_updated_at", now)
+	rdb.Send("SET", fmt.Sprintf("user_public_memo_updated_at:%d", userId), now)
+}
+
+func (x *redisIndex) TagMemos(tag string, offset, limit int) ([]int, int, error) {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer c.Close()
+	key := "tag_public_memos:" + tag
+	ids, err := redis.Ints(c.Do("ZREVRANGE", key, offset, offset+limit-1))
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := redis.Int(c.Do("ZCARD", key))
+	return ids, total, err
+}
+
+func (x *redisIndex) UserTagMemos(userId int, tag string) ([]int, error) {
+	return x.ints("ZRANGE", fmt.Sprintf("user_tag_memos:%d:%s", userId, tag), 0, -1)
+}
+
+func (x *redisIndex) TagCloud() ([]*TagCount, error) {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return tagCloud(c, "tag_cloud")
+}
+
+func (x *redisIndex) UserTagCloud(userId int) ([]*TagCount, error) {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return tagCloud(c, fmt.Sprintf("user_tag_cloud:%d", userId))
+}
+
+func (x *redisIndex) Search(grams []string) ([]int, error) {
+	args := make([]interface{}, len(grams))
+	for i, g := range grams {
+		args[i] = searchKeyPrefix + g
+	}
+	return x.ints("SINTER", args...)
+}
+
+// redisAddChunk is how many memos redisIndex.Add queues in one
+// MULTI/EXEC. A memo has a SADD per distinct bigram, so a /init batch
+// in one transaction would be queued, and held, all at once.
+const redisAddChunk = 100
+
+func (x *redisIndex) Add(memos ...*Memo) error {
+	for len(memos) > redisAddChunk {
+		if err := x.add(memos[:redisAddChunk]); err != nil {
+			return err
+		}
+		memos = memos[redisAddChunk:]
+	}
+	return x.add(memos)
+}
+
+func (x *redisIndex) add(memos []*Memo) error {
+	return x.exec(func(c redis.Conn) {
+		for _, m := range memos {
+			c.Send("ZADD", fmt.Sprintf("user_memos:%d", m.User), m.Id, m.Id)
+			if m.IsPrivate == 0 {
+				publish(c, m)
+			}
+			indexMemo(c, m.Id, m.Content)
+			indexMemoTags(c, m.Id, m.User, m.IsPrivate, m.Tags)
+		}
+	})
+}
+
+func (x *redisIndex) Restore(memo *Memo) error {
+	return x.exec(func(c redis.Conn) {
+		c.Send("ZADD", fmt.Sprintf("user_memos:%d", memo.User), memo.Id, memo.Id)
+		if memo.IsPrivate == 0 {
+			publish(c, memo)
+		}
+		indexMemo(c, memo.Id, memo.Content)
+		indexMemoTags(c, memo.Id, memo.User, memo.IsPrivate, memo.Tags)
+	})
+}
+
+// publish and unpublish queue the commands that add memo to the public
+// sets or take it out of them.
+func publish(rdb redis.Conn, memo *Memo) {
+	rdb.Send("ZADD", "public_memos", memo.Id, memo.Id)
+	rdb.Send("ZADD", fmt.Sprintf("user_public_memos:%d", memo.User), memo.Id, memo.Id)
+	touchPublic(rdb, memo.User)
+}
+
+func unpublish(rdb redis.Conn, memo *Memo) {
+	rdb.Send("ZREM", "public_memos", memo.Id)
+	rdb.Send("ZREM", fmt.Sprintf("user_public_memos:%d", memo.User), memo.Id)
+	touchPublic(rdb, memo.User)
+}
+
+func (x *redisIndex) Update(old, memo *Memo) error {
+	return x.exec(func(c redis.Conn) {
+		if memo.Content != old.Content {
+			unindexMemo(c, old.Id, old.Content)
+			indexMemo(c, memo.Id, memo.Content)
+		}
+		unindexMemoTags(c, old.Id, old.User, old.IsPrivate, old.Tags)
+		indexMemoTags(c, memo.Id, memo.User, memo.IsPrivate, memo.Tags)
+		if memo.IsPrivate == 1 && old.IsPrivate == 0 {
+			unpublish(c, memo)
+		} else if memo.IsPrivate == 0 && old.IsPrivate == 1 {
+			publish(c, memo)
+		} else if memo.IsPrivate == 0 {
+			touchPublic(c, memo.User)
+		}
+	})
+}
+
+func (x *redisIndex) Remove(memo *Memo) error {
+	return x.exec(func(c redis.Conn) {
+		c.Send("ZREM", fmt.Sprintf("user_memos:%d", memo.User), memo.Id)
+		unindexMemo(c, memo.Id, memo.Content)
+		unindexMemoTags(c, memo.Id, memo.User, memo.IsPrivate, memo.Tags)
+		if memo.IsPrivate == 0 {
+			unpublish(c, memo)
+		}
+	})
+}
+
+// redisIndexKeys and redisIndexPrefixes name every key of the index, the
+// lists of the older index included.
+var (
+	redisIndexKeys = map[string]bool{
+		"public_memos": true, "public_memo_updated_at": true, "tag_cloud": true,
+		redisMigratedKey: true, "public_memo_list": true, "migrated_at": true,
+	}
+	redisIndexPrefixes = []string{
+		"user_public_memos:", "user_memos:", "user_public_memo_updated_at:",
+		"tag_public_memos:", "user_tag_memos:", "user_tag_cloud:", searchKeyPrefix,
+		"user_public_memo_list:", "user_memo_list:",
+	}
+)
+
+func isRedisIndexKey(key string) bool {
+	if redisIndexKeys[key] {
+		return true
+	}
+	for _, p := range redisIndexPrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reset deletes the index keys, SCANning for them rather than flushing the
+// database: /init needs no authentication, and the login throttle counters
+// and shared renders live there too.
+func (x *redisIndex) Reset() error {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	cursor := 0
+	for {
+		values, err := redis.Values(redis.DoWithTimeout(c, 0, "SCAN", cursor, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		args := redis.Args{}
+		for _, k := range keys {
+			if isRedisIndexKey(k) {
+				args = args.Add(k)
+			}
+		}
+		if len(args) > 0 {
+			if _, err := redis.DoWithTimeout(c, 0, "DEL", args...); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (x *redisIndex) MarkMigrated() error {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Do("SET", redisMigratedKey, time.Now().Unix())
+	return err
+}
+
+// migratedContext is Migrated for /readyz, failing rather than waiting
+// for a connection or a reply past ctx's deadline.
+func (x *redisIndex) migratedContext(ctx context.Context) (bool, error) {
+	c, err := x.pool.GetContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return false, context.DeadlineExceeded
+		}
+	}
+	return redis.Bool(redis.DoWithTimeout(c, timeout, "EXISTS", redisMigratedKey))
+}
+
+func (x *redisIndex) Migrated() (bool, error) {
+	c, err := redisConn(x.pool, x.wait)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	return redis.Bool(c.Do("EXISTS", redisMigratedKey))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRedisConnWaitIsBounded(t *testing.T) {
+	pool := &redis.Pool{
+		MaxActive: 1,
+		Wait:      true,
+		Dial: func() (redis.Conn, error) {
+			c, _ := net.Pipe()
+			return redis.NewConn(c, 0, 0), nil
+		},
+	}
+	busy, err := redisConn(pool, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if c, err := redisConn(pool, 50*time.Millisecond); err == nil {
+		c.Close()
+		t.Fatal("got a second connection from a pool of one")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %s for a connection", d)
+	}
+	busy.Close()
+	c, err := redisConn(pool, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("after one was given back: %v", err)
+	}
+	c.Close()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Rendered memo HTML is cached by content rather than by memo id, under
+//
+//	md:{version}:{sha256 of the Markdown in hex}
+//
+// where version names the rendering code, the renderer and the sanitize
+// policy, so changing any of them misses instead of serving HTML made the
+// old way. The first tier
+// is an LRU in process bounded by bytes. render_cache.shared puts Redis or
+// memcache behind it so that app instances share their renders.
+
+// RenderCacheConfig is the render_cache section of the config file.
+type RenderCacheConfig struct {
+	// MaxBytes bounds the HTML kept in process.
+	MaxBytes int64 `json:"max_bytes"`
+	// Shared is "redis" or "memcache" for a second tier, or empty for none.
+	Shared string `json:"shared"`
+	// SharedTTLSeconds is how long an entry lives in the second tier.
+	SharedTTLSeconds int `json:"shared_ttl_seconds"`
+	// WarmWorkers is how many goroutines render memos once /init has
+	// rebuilt the index.
+	WarmWorkers int `json:"warm_workers"`
+}
+
+const (
+	renderCacheRedis    = "redis"
+	renderCacheMemcache = "memcache"
+)
+
+func (c RenderCacheConfig) withDefaults() RenderCacheConfig {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 64 << 20
+	}
+	if c.SharedTTLSeconds <= 0 {
+		c.SharedTTLSeconds = 24 * 60 * 60
+	}
+	if c.WarmWorkers <= 0 {
+		c.WarmWorkers = runtime.GOMAXPROCS(0)
+	}
+	return c
+}
+
+// rendererVersion changes whenever the code would make different HTML
+// from the same Markdown and config: a change to a renderer, to
+// highlight.go or to the built-in sanitize policy. Config changes are
+// covered by the rest of renderCacheVersion.
+const rendererVersion = "3"
+
+// renderCacheVersion is rendererVersion qualified by the renderer's
+// version and the sanitize policy, which between them decide the HTML
+// made from given Markdown.
+func renderCacheVersion(r markdownRenderer, s SanitizeConfig) string {
+	b, _ := json.Marshal(s)
+	sum := sha256.Sum256([]byte(r.version() + "\n" + string(b)))
+	return rendererVersion + "." + hex.EncodeToString(sum[:8])
+}
+
+func renderCacheKey(version, md string) string {
+	sum := sha256.Sum256([]byte(md))
+	return "md:" + version + ":" + hex.EncodeToString(sum[:])
+}
+
+// lruCache holds rendered HTML up to maxBytes, counting keys and values,
+// and drops the least recently used entries to stay under it.
+type lruCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	html template.HTML
+}
+
+func (e *lruEntry) size() int64 {
+	return int64(len(e.key) + len(e.html))
+}
+
+func newLRUCache(maxBytes int64) *lruCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) get(key string) (template.HTML, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).html, true
+}
+
+// add stores html at key and returns how many entries were evicted to
+// make room. An entry bigger than the whole cache is not stored.
+func (c *lruCache) add(key string, html template.HTML) (evicted int) {
+	e := &lruEntry{key, html}
+	if e.size() > c.maxBytes {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.bytes -= el.Value.(*lruEntry).size()
+		el.Value = e
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(e)
+	}
+	c.bytes += e.size()
+	for c.bytes > c.maxBytes {
+		el := c.ll.Back()
+		old := el.Value.(*lruEntry)
+		c.ll.Remove(el)
+		delete(c.items, old.key)
+		c.bytes -= old.size()
+		evicted++
+	}
+	return evicted
+}
+
+// stats returns the number of entries and their size in bytes.
+func (c *lruCache) stats() (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len(), c.bytes
+}
+
+// sharedRenderCache is the second tier. redisRenderCache and
+// memcacheRenderCache implement it.
+type sharedRenderCache interface {
+	get(key string) (html []byte, found bool, err error)
+	set(key string, html []byte) error
+}
+
+func newSharedRenderCache(c RenderCacheConfig, pool *redis.Pool, wait time.Duration, memcacheAddr string) (sharedRenderCache, error) {
+	ttl := time.Duration(c.SharedTTLSeconds) * time.Second
+	switch c.Shared {
+	case "":
+		return nil, nil
+	case renderCacheRedis:
+		if pool == nil {
+			return nil, fmt.Errorf("render_cache: shared %q needs the mysql storage", c.Shared)
+		}
+		return &redisRenderCache{pool, wait, ttl}, nil
+	case renderCacheMemcache:
+		return &memcacheRenderCache{memcache.New(memcacheAddr), ttl}, nil
+	}
+	return nil, fmt.Errorf("render_cache: shared %q is neither %q nor %q", c.Shared, renderCacheRedis, renderCacheMemcache)
+}
+
+type redisRenderCache struct {
+	pool *redis.Pool
+	wait time.Duration
+	ttl  time.Duration
+}
+
+func (s *redisRenderCache) get(key string) ([]byte, bool, error) {
+	c, err := redisConn(s.pool, s.wait)
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.Close()
+	b, err := redis.Bytes(c.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	return b, err == nil, err
+}
+
+func (s *redisRenderCache) set(key string, html []byte) error {
+	c, err := redisConn(s.pool, s.wait)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Do("SET", key, html, "EX", int64(s.ttl/time.Second))
+	return err
+}
+
+type memcacheRenderCache struct {
+	client *memcache.Client
+	ttl    time.Duration
+}
+
+func (s *memcacheRenderCache) get(key string) ([]byte, bool, error) {
+	item, err := s.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return item.Value, true, nil
+}
+
+func (s *memcacheRenderCache) set(key string, html []byte) error {
+	return s.client.Set(&memcache.Item{Key: key, Value: html, Expiration: int32(s.ttl / time.Second)})
+}
+
+// getHTML looks md up in process and then in the shared tier, copying a
+// shared hit into the process. Errors are logged against request reqID.
+func (app *App) getHTML(reqID, md string) (template.HTML, bool) {
+	key := renderCacheKey(app.renderVersion, md)
+	h, found := app.renders.get(key)
+	app.metrics.countCacheLookup("markdown", found)
+	if found || app.sharedRenders == nil {
+		return h, found
+	}
+	b, found, err := app.sharedRenders.get(key)
+	if err != nil {
+		logErrorID(reqID, fmt.Errorf("render cache: %s", err))
+	}
+	app.metrics.countCacheLookup("markdown_shared", found)
+	if !found {
+		return "", false
+	}
+	h = template.HTML(b)
+	app.metrics.renderCacheEvictions.Add(float64(app.renders.add(key, h)))
+	return h, true
+}
+
+// cacheHTML renders md into both tiers and returns the HTML.
+func (app *App) cacheHTML(reqID, md string) template.HTML {
+	key := renderCacheKey(app.renderVersion, md)
+	h := app.renderMarkdown(md)
+	app.metrics.renderCacheEvictions.Add(float64(app.renders.add(key, h)))
+	if app.sharedRenders != nil {
+		if err := app.sharedRenders.set(key, []byte(h)); err != nil {
+			logErrorID(reqID, fmt.Errorf("render cache: %s", err))
+		}
+	}
+	return h
+}
+
+// warmRenders starts RenderCache.WarmWorkers goroutines that cache the
+// Markdown sent on the returned channel, logging errors against request
+// reqID. Sends block while they are all busy; close the channel to stop
+// them.
+func (app *App) warmRenders(reqID string) chan<- string {
+	mds := make(chan string, 256)
+	for i := 0; i < app.warmWorkers; i++ {
+		go func() {
+			for md := range mds {
+				app.genMarkdown(reqID, md)
+			}
+		}()
+	}
+	return mds
+}
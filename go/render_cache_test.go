@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLRUCacheEvictsByBytes(t *testing.T) {
+	c := newLRUCache(30)
+	c.add("a", "aaaaaaaaa") // 10 bytes with the key
+	c.add("b", "bbbbbbbbb")
+	c.add("c", "ccccccccc")
+	if n, size := c.stats(); n != 3 || size != 30 {
+		t.Fatalf("stats = %d entries, %d bytes", n, size)
+	}
+	c.get("a")
+	if evicted := c.add("d", "ddddddddd"); evicted != 1 {
+		t.Fatalf("add over the limit evicted %d", evicted)
+	}
+	if _, found := c.get("b"); found {
+		t.Error("least recently used entry kept")
+	}
+	if h, found := c.get("a"); !found || h != "aaaaaaaaa" {
+		t.Error("recently used entry evicted")
+	}
+
+	if c.add("big", template.HTML(strings.Repeat("x", 40))) != 0 {
+		t.Error("an oversized entry evicted others")
+	}
+	if _, found := c.get("big"); found {
+		t.Error("an oversized entry was stored")
+	}
+	c.add("a", "a")
+	if _, size := c.stats(); size != 22 {
+		t.Errorf("size after replacing an entry = %d, want 22", size)
+	}
+}
+
+// mapRenderCache is a sharedRenderCache standing in for Redis or memcache.
+type mapRenderCache struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func (s *mapRenderCache) get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.m[key]
+	return b, ok, nil
+}
+
+func (s *mapRenderCache) set(key string, html []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[key] = html
+	return nil
+}
+
+func TestRenderCacheSharedTier(t *testing.T) {
+	shared := &mapRenderCache{m: make(map[string][]byte)}
+	a := newTestApp(t, nil)
+	b := newTestApp(t, nil)
+	a.sharedRenders = shared
+	b.sharedRenders = shared
+
+	md := "# shared\n\n[link](https://example.com)"
+	want := a.genMarkdown("", md)
+	if len(shared.m) != 1 {
+		t.Fatalf("shared tier has %d entries after a render", len(shared.m))
+	}
+	hits := b.metrics.cacheLookups.WithLabelValues("markdown_shared", "hit")
+	if h, found := b.getHTML("", md); !found || h != want {
+		t.Fatalf("b.getHTML = %q, %v", h, found)
+	}
+	if testutil.ToFloat64(hits) != 1 {
+		t.Error("shared hit not counted")
+	}
+	if _, found := b.renders.get(renderCacheKey(b.renderVersion, md)); !found {
+		t.Error("shared hit not copied into the process")
+	}
+
+	c := newTestApp(t, func(c *Config) { c.Sanitize.LinkRel = "nofollow" })
+	c.sharedRenders = shared
+	if c.renderVersion == a.renderVersion {
+		t.Fatal("a different sanitize policy has the same render version")
+	}
+	if !strings.HasPrefix(a.renderVersion, rendererVersion+".") {
+		t.Errorf("render version %q does not start with rendererVersion", a.renderVersion)
+	}
+	if h := c.genMarkdown("", md); !strings.Contains(string(h), `rel="nofollow"`) {
+		t.Errorf("render made under another policy served: %s", h)
+	}
+}
+
+type downRenderCache struct{}
+
+func (downRenderCache) get(string) ([]byte, bool, error) { return nil, false, errors.New("down") }
+func (downRenderCache) set(string, []byte) error        { return errors.New("down") }
+
+func TestRenderCacheErrorsCarryRequestID(t *testing.T) {
+	app, srv := newTestServer(t, nil)
+	app.sharedRenders = downRenderCache{}
+	app.renders = newLRUCache(0) // every page render misses
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	c := newTestClient(t, srv)
+	c.signUp("alice")
+	c.header.Set(requestIDHeader, "memo-post")
+	id := c.postMemo("# hello", false)
+	c.header.Set(requestIDHeader, "memo-get")
+	c.get(fmt.Sprintf("/memo/%d", id))
+	for _, want := range []string{"error: [memo-post] render cache: down", "error: [memo-get] render cache: down"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRebuildIndexWarmsRenders(t *testing.T) {
+	app := newMemoryTestApp(t, func(c *Config) { c.RenderCache.WarmWorkers = 2 })
+	for i := 0; i < 20; i++ {
+		if err := app.Memos.CreateMemo(&Memo{User: 1, Content: fmt.Sprintf("memo *%d*", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.rebuildIndex(""); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if n, _ := app.renders.stats(); n == 20 {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%d of 20 memos rendered", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
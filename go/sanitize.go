@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/net/html"
+)
+
+// Memo HTML comes from Markdown that may carry raw HTML, so it is cleaned
+// against an allowlist after rendering and before it is cached or shown.
+// Anything not listed here, including every on* handler and javascript:
+// URL, is dropped.
+
+// SanitizeConfig is the sanitize section of the config file.
+type SanitizeConfig struct {
+	// ExtraElements are allowed on top of the defaults below, with no
+	// attributes unless ExtraAttributes lists some.
+	ExtraElements []string `json:"extra_elements"`
+	// ExtraAttributes maps an element name to more attributes allowed on
+	// it. Event handler attributes (on*) are refused.
+	ExtraAttributes map[string][]string `json:"extra_attributes"`
+	// URLSchemes replaces the default http, https and mailto for href and
+	// src; relative URLs are always allowed.
+	URLSchemes []string `json:"url_schemes"`
+	// LinkRel is set as the rel of every link, replacing any in the memo.
+	LinkRel string `json:"link_rel"`
+}
+
+var (
+	// sanitizeElements is what the Markdown engines produce, with every
+	// extension on (see markdown.go).
+	sanitizeElements = []string{
+		"p", "br", "hr", "h1", "h2", "h3", "h4", "h5", "h6", "div",
+		"a", "img", "blockquote", "pre", "code", "span", "em", "strong", "del", "sup", "sub",
+		"ul", "ol", "li", "dl", "dt", "dd", "input",
+		"table", "thead", "tbody", "tr", "th", "td",
+	}
+	defaultURLSchemes = []string{"http", "https", "mailto"}
+
+	// Heading anchors and footnotes need ids and a few classes.
+	anchorID      = regexp.MustCompile(`^[A-Za-z0-9_:.-]+$`)
+	footnoteClass = regexp.MustCompile(`^footnote(s|-ref|-backref)$`)
+)
+
+const defaultLinkRel = "nofollow noopener"
+
+type htmlSanitizer struct {
+	policy  *bluemonday.Policy
+	linkRel string
+}
+
+func newHTMLSanitizer(c SanitizeConfig) (*htmlSanitizer, error) {
+	p := bluemonday.NewPolicy()
+	p.AllowElements(sanitizeElements...)
+	p.AllowAttrs("href", "title").OnElements("a")
+	p.AllowAttrs("src", "alt", "title").OnElements("img")
+	p.AllowAttrs("align").Matching(bluemonday.CellAlign).OnElements("th", "td")
+	p.AllowAttrs("class").Matching(bluemonday.SpaceSeparatedTokens).OnElements("code")
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowAttrs("id").Matching(anchorID).OnElements("h1", "h2", "h3", "h4", "h5", "h6", "sup", "li")
+	p.AllowAttrs("class").Matching(footnoteClass).OnElements("div", "sup", "a")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^chroma$`)).OnElements("pre")
+	p.AllowAttrs("class").Matching(highlightClass).OnElements("span")
+
+	schemes := c.URLSchemes
+	if len(schemes) == 0 {
+		schemes = defaultURLSchemes
+	}
+	p.AllowURLSchemes(schemes...)
+	p.AllowRelativeURLs(true)
+	p.RequireParseableURLs(true)
+
+	p.AllowElements(c.ExtraElements...)
+	for elem, attrs := range c.ExtraAttributes {
+		for _, a := range attrs {
+			if strings.HasPrefix(strings.ToLower(a), "on") {
+				return nil, fmt.Errorf("sanitize: %s: event handler attribute %q cannot be allowed", elem, a)
+			}
+		}
+		p.AllowAttrs(attrs...).OnElements(elem)
+	}
+
+	rel := c.LinkRel
+	if rel == "" {
+		rel = defaultLinkRel
+	}
+	return &htmlSanitizer{policy: p, linkRel: rel}, nil
+}
+
+// sanitize cleans rendered memo HTML.
+func (s *htmlSanitizer) sanitize(b []byte) []byte {
+	return rewriteTags(s.policy.SanitizeBytes(b), s.linkRel)
+}
+
+// rewriteTags sets rel on every <a href> in b and drops any <input> that
+// is not a task list checkbox. b must already be sanitised: those tags are
+// rewritten, everything else is copied as is.
+func rewriteTags(b []byte, rel string) []byte {
+	var out bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(b))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return out.Bytes()
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.Write(z.Raw())
+			continue
+		}
+		raw := append([]byte(nil), z.Raw()...)
+		t := z.Token()
+		if t.Data == "input" && !hasAttr(t, "type") {
+			continue
+		}
+		if t.Data != "a" || !hasAttr(t, "href") {
+			out.Write(raw)
+			continue
+		}
+		attrs := t.Attr[:0]
+		for _, a := range t.Attr {
+			if a.Key != "rel" {
+				attrs = append(attrs, a)
+			}
+		}
+		t.Attr = append(attrs, html.Attribute{Key: "rel", Val: rel})
+		out.WriteString(t.String())
+	}
+}
+
+func hasAttr(t html.Token, key string) bool {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
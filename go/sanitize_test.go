@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// xssPayloads are memo bodies that try to get script into the page.
+var xssPayloads = []string{
+	`<script>alert(1)</script>`,
+	`<SCRIPT SRC=https://evil.example/x.js></SCRIPT>`,
+	`<<script>script>alert(1)<</script>/script>`,
+	`<scr<script>ipt>alert(1)</script>`,
+	`"><script>alert(1)</script>`,
+	`<img src=x onerror=alert(1)>`,
+	`<IMG SRC="javascript:alert('XSS');">`,
+	`<img src="x` + "`" + `onerror=alert(1)` + "`" + `>`,
+	`<a href="javascript:alert(1)">x</a>`,
+	`<a href=" javascript:alert(1)">x</a>`,
+	`<a href="&#106;avascript:alert(1)">x</a>`,
+	`<a href="jav&#x09;ascript:alert(1)">x</a>`,
+	`<a href="vbscript:msgbox(1)">x</a>`,
+	`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">x</a>`,
+	`<a href="https://ok.example" onclick="alert(1)" rel="opener">ok</a>`,
+	`[x](javascript:alert(1))`,
+	`[x](JaVaScRiPt:alert(1))`,
+	`[x](javascript&#58;alert(1))`,
+	`![x](javascript:alert(1))`,
+	`[x]: javascript:alert(1)` + "\n\n[y][x]",
+	`<svg onload=alert(1)>`,
+	`<svg><script>alert(1)</script></svg>`,
+	`<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>`,
+	`<noscript><p title="</noscript><img src=x onerror=alert(1)>">`,
+	`<iframe src="https://evil.example"></iframe>`,
+	`<iframe srcdoc="<script>alert(1)</script>"></iframe>`,
+	`<object data="javascript:alert(1)"></object>`,
+	`<embed src="javascript:alert(1)">`,
+	`<form action="javascript:alert(1)"><input type=submit></form>`,
+	`<button formaction="javascript:alert(1)">x</button>`,
+	`<body onload=alert(1)>`,
+	`<details open ontoggle=alert(1)>`,
+	`<div style="background:url(javascript:alert(1))">x</div>`,
+	`<style>@import 'https://evil.example/x.css';</style>`,
+	`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+	`<base href="javascript:alert(1)//">`,
+	`<link rel=stylesheet href="javascript:alert(1)">`,
+	`<textarea><script>alert(1)</script></textarea>`,
+	`<p onmouseover="alert(1)">hover</p>`,
+	`<table><td background="javascript:alert(1)">x</td></table>`,
+	`<input type=text name=password>`,
+	`<input checked autofocus onfocus=alert(1)>`,
+	`<h1 id="x onmouseover=alert(1)">x</h1>`,
+	`<div class="footnotes" style="position:fixed">x</div>`,
+	"```\n<script>alert(1)</script>\n```",
+	"`<script>alert(1)</script>`",
+}
+
+// checkSafeHTML fails t if out has an element or attribute outside the
+// default allowlist, an event handler, or a URL with a disallowed scheme.
+func checkSafeHTML(t *testing.T, in, out string) {
+	t.Helper()
+	allowed := make(map[string]bool)
+	for _, e := range sanitizeElements {
+		allowed[e] = true
+	}
+	z := html.NewTokenizer(strings.NewReader(out))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		tok := z.Token()
+		if !allowed[tok.Data] {
+			t.Errorf("%q: element <%s> survived: %s", in, tok.Data, out)
+		}
+		for _, a := range tok.Attr {
+			if strings.HasPrefix(a.Key, "on") || a.Key == "style" {
+				t.Errorf("%q: attribute %s survived: %s", in, a.Key, out)
+			}
+			if a.Key != "href" && a.Key != "src" {
+				continue
+			}
+			u, err := url.Parse(a.Val)
+			if err != nil {
+				t.Errorf("%q: unparseable %s survived: %s", in, a.Key, out)
+				continue
+			}
+			switch strings.ToLower(u.Scheme) {
+			case "", "http", "https", "mailto":
+			default:
+				t.Errorf("%q: %s with scheme %q survived: %s", in, a.Key, u.Scheme, out)
+			}
+		}
+	}
+}
+
+func TestSanitizeXSSPayloads(t *testing.T) {
+	app := newTestApp(t, nil)
+	for _, p := range xssPayloads {
+		checkSafeHTML(t, p, string(app.renderMarkdown(p)))
+	}
+}
+
+func TestSanitizeKeepsMarkdown(t *testing.T) {
+	app := newTestApp(t, nil)
+	tests := []struct {
+		md, want string
+	}{
+		{"# Title", "<h1>Title</h1>"},
+		{"**bold** and ~~gone~~", "<strong>bold</strong> and <del>gone</del>"},
+		{"[site](https://example.com/a?b=1&c=2)", `<a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener">site</a>`},
+		{"[tag](/tag/go)", `<a href="/tag/go" rel="nofollow noopener">tag</a>`},
+		{`<a href="https://example.com" rel="opener">x</a>`, `<a href="https://example.com" rel="nofollow noopener">x</a>`},
+		{"![logo](https://example.com/l.png)", `<img src="https://example.com/l.png" alt="logo"`},
+		{"```go\nx := 1\n```", `<pre class="chroma"><code class="language-go"><span class="nx">x</span>`},
+		{"```\nx := 1\n```", "<pre><code>x := 1"},
+		{"| a | b |\n|:--|--:|\n| 1 | 2 |", `<td align="left">1</td>`},
+		{"a < b & c", "a &lt; b &amp; c"},
+	}
+	for _, tt := range tests {
+		if got := string(app.renderMarkdown(tt.md)); !strings.Contains(got, tt.want) {
+			t.Errorf("renderMarkdown(%q) = %q, want it to contain %q", tt.md, got, tt.want)
+		}
+	}
+}
+
+func TestCachedHTMLIsSanitized(t *testing.T) {
+	app := newTestApp(t, nil)
+	md := "hello <script>alert(1)</script><img src=x onerror=alert(1)>"
+	app.cacheHTML("", md)
+	h, found := app.getHTML("", md)
+	if !found {
+		t.Fatal("not cached")
+	}
+	checkSafeHTML(t, md, string(h))
+	if strings.Contains(string(h), "alert") {
+		t.Errorf("cached HTML keeps the payload: %s", h)
+	}
+}
+
+func TestSanitizeConfig(t *testing.T) {
+	s, err := newHTMLSanitizer(SanitizeConfig{
+		ExtraElements:   []string{"kbd"},
+		ExtraAttributes: map[string][]string{"abbr": {"title"}},
+		URLSchemes:      []string{"https"},
+		LinkRel:         "nofollow ugc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := `<kbd>Ctrl</kbd> <abbr title="HyperText">HTML</abbr> <a href="http://a.example">a</a> <a href="https://b.example">b</a>`
+	got := string(s.sanitize([]byte(in)))
+	for _, want := range []string{
+		"<kbd>Ctrl</kbd>",
+		`<abbr title="HyperText">HTML</abbr>`,
+		`<a href="https://b.example" rel="nofollow ugc">b</a>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sanitize = %q, want it to contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "http://a.example") {
+		t.Errorf("http link kept with url_schemes [https]: %q", got)
+	}
+
+	_, err = newHTMLSanitizer(SanitizeConfig{ExtraAttributes: map[string][]string{"p": {"OnClick"}}})
+	if err == nil {
+		t.Fatal("an event handler attribute was allowed")
+	}
+}
+
+func TestSanitizeKeepsOnlyCheckboxInputs(t *testing.T) {
+	s, err := newHTMLSanitizer(SanitizeConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(s.sanitize([]byte(`<input type="text"><input checked><input checked="" disabled="" type="checkbox" /> done`)))
+	if want := `<input checked="" disabled="" type="checkbox"/> done`; got != want {
+		t.Errorf("sanitize = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Memos are indexed in one set of ids for every bigram of the lower-cased
+// content; in Redis these are the sets keyed "search:<gram>". N-grams need
+// no word segmentation, which matters for Japanese. Single characters are
+// not indexed, since their sets would hold nearly every memo, so a query
+// needs a word of at least two. The index only narrows the candidates;
+// hits are checked against the memo content and its visibility, newest
+// first, until a page is filled. Only the searchMaxCandidates newest hits
+// are checked, and results say when older ones were left out.
+
+const (
+	searchKeyPrefix    = "search:"
+	searchSnippetRunes = 40
+	// searchBatch is how many candidates are loaded at a time, and
+	// searchMaxCandidates how many are looked at for one page at most.
+	searchBatch         = 100
+	searchMaxCandidates = 5000
+)
+
+var errQueryTooShort = errors.New("search words need at least 2 letters or digits")
+
+type SearchResult struct {
+	*Memo
+	Snippet template.HTML `json:"snippet"`
+}
+
+type apiSearchResults struct {
+	Results []*SearchResult `json:"results"`
+	Page    int             `json:"page"`
+	PerPage int             `json:"per_page"`
+	HasMore bool            `json:"has_more"`
+	// Capped is true when the query matched more memos than are looked at,
+	// and older matches may be missing.
+	Capped bool `json:"capped"`
+}
+
+// searchRuns splits s into lower-cased runs of letters and digits.
+func searchRuns(s string) [][]rune {
+	runs := make([][]rune, 0)
+	run := make([]rune, 0)
+	for _, c := range strings.ToLower(s) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsMark(c) {
+			run = append(run, c)
+			continue
+		}
+		if len(run) > 0 {
+			runs = append(runs, run)
+			run = make([]rune, 0)
+		}
+	}
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// indexGrams returns every distinct bigram in content.
+func indexGrams(content string) []string {
+	seen := make(map[string]bool)
+	grams := make([]string, 0)
+	add := func(g string) {
+		if !seen[g] {
+			seen[g] = true
+			grams = append(grams, g)
+		}
+	}
+	for _, run := range searchRuns(content) {
+		for i := 0; i+1 < len(run); i++ {
+			add(string(run[i : i+2]))
+		}
+	}
+	return grams
+}
+
+// queryGrams returns the bigrams that every document containing all terms
+// must have. One-character runs give none.
+func queryGrams(terms []string) []string {
+	seen := make(map[string]bool)
+	grams := make([]string, 0)
+	for _, term := range terms {
+		for _, run := range searchRuns(term) {
+			for i := 0; i+1 < len(run); i++ {
+				seen[string(run[i:i+2])] = true
+			}
+		}
+	}
+	for g := range seen {
+		grams = append(grams, g)
+	}
+	sort.Strings(grams)
+	return grams
+}
+
+func searchTerms(q string) []string {
+	return strings.Fields(strings.ToLower(q))
+}
+
+// indexMemo queues SADDs for memo on rdb; callers flush it, usually inside
+// MULTI/EXEC.
+func indexMemo(rdb redis.Conn, memoId int, content string) {
+	for _, g := range indexGrams(content) {
+		rdb.Send("SADD", searchKeyPrefix+g, memoId)
+	}
+}
+
+func unindexMemo(rdb redis.Conn, memoId int, content string) {
+	for _, g := range indexGrams(content) {
+		rdb.Send("SREM", searchKeyPrefix+g, memoId)
+	}
+}
+
+// searchMemos returns up to limit memos visible to user that contain
+// every term, newest first, after skipping offset of them, and whether
+// there are more. Only the searchMaxCandidates newest index hits are
+// looked at; capped reports that there were more hits than that. It
+// returns errQueryTooShort if q has terms but no bigram.
+func (app *App) searchMemos(q string, user *User, offset, limit int) (results []*SearchResult, more, capped bool, err error) {
+	results = make([]*SearchResult, 0)
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return results, false, false, nil
+	}
+	grams := queryGrams(terms)
+	if len(grams) == 0 {
+		return nil, false, false, errQueryTooShort
+	}
+	ids, err := app.Index.Search(grams)
+	if err != nil {
+		return nil, false, false, err
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	if len(ids) > searchMaxCandidates {
+		ids = ids[:searchMaxCandidates]
+		capped = true
+	}
+
+	for start := 0; start < len(ids); start += searchBatch {
+		end := start + searchBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		memos, err := app.lookupMemoMulti(ids[start:end])
+		if err != nil {
+			return nil, false, false, err
+		}
+		for _, m := range memos {
+			if m.IsPrivate != 0 && (user == nil || user.Id != m.User) {
+				continue
+			}
+			if !containsAll(m.Content, terms) {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			if len(results) == limit {
+				return results, true, capped, nil
+			}
+			results = append(results, &SearchResult{Memo: m, Snippet: highlightSnippet(m.Content, terms)})
+		}
+	}
+	return results, false, capped, nil
+}
+
+func containsAll(content string, terms []string) bool {
+	lower := strings.ToLower(content)
+	for _, t := range terms {
+		if !strings.Contains(lower, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// highlightSnippet returns an escaped excerpt around the first match with
+// every term wrapped in <mark>.
+func highlightSnippet(content string, terms []string) template.HTML {
+	text := []rune(content)
+	lower := []rune(strings.ToLower(content))
+	if len(lower) != len(text) {
+		// lower-casing changed the length; fall back to matching as is
+		lower = text
+	}
+	marked := make([]bool, len(text))
+	first := -1
+	for _, t := range terms {
+		tr := []rune(t)
+		for i := 0; i+len(tr) <= len(lower); i++ {
+			if string(lower[i:i+len(tr)]) != t {
+				continue
+			}
+			for j := i; j < i+len(tr); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	if first < 0 {
+		first = 0
+	}
+	start := first - searchSnippetRunes
+	if start < 0 {
+		start = 0
+	}
+	end := first + searchSnippetRunes*2
+	if end > len(text) {
+		end = len(text)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("...")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		s := html.EscapeString(string(text[i:j]))
+		if marked[i] {
+			b.WriteString("<mark>" + s + "</mark>")
+		} else {
+			b.WriteString(s)
+		}
+		i = j
+	}
+	if end < len(text) {
+		b.WriteString("...")
+	}
+	return template.HTML(b.String())
+}
+
+func searchPage(r *http.Request) (int, bool) {
+	p := r.FormValue("page")
+	if p == "" {
+		return 0, true
+	}
+	page, err := strconv.Atoi(p)
+	return page, err == nil && page >= 0
+}
+
+func (app *App) searchHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	page, ok := searchPage(r)
+	if !ok {
+		notFound(w)
+		return
+	}
+	user := app.getUser(w, r, session)
+
+	q := r.FormValue("q")
+	var errs []string
+	results, more, capped, err := app.searchMemos(q, user, app.MemosPerPage*page, app.MemosPerPage)
+	if err == errQueryTooShort {
+		errs = []string{err.Error()}
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	if page > 0 && len(results) == 0 {
+		notFound(w)
+		return
+	}
+
+	v := &View{
+		Page:      page,
+		PageStart: app.MemosPerPage*page + 1,
+		PageEnd:   app.MemosPerPage*page + len(results),
+		HasNext:   more,
+		Capped:    capped,
+		Query:     q,
+		Results:   results,
+		Errors:    errs,
+		User:      user,
+		Session:   session,
+	}
+	if err = app.render(w, r, "search", v); err != nil {
+		serverError(w, err)
+	}
+}
+
+func (app *App) apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	page, ok := searchPage(r)
+	if !ok {
+		apiError(w, http.StatusBadRequest, "invalid page")
+		return
+	}
+	user, err := app.lookupUser(w, r, session)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	results, more, capped, err := app.searchMemos(r.FormValue("q"), user, app.MemosPerPage*page, app.MemosPerPage)
+	if err == errQueryTooShort {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, &apiSearchResults{
+		Results: results,
+		Page:    page,
+		PerPage: app.MemosPerPage,
+		HasMore: more,
+		Capped:  capped,
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIndexGramsCoverQueryGrams(t *testing.T) {
+	content := "今日はGoでISUCONの練習をした"
+	indexed := make(map[string]bool)
+	for _, g := range indexGrams(content) {
+		indexed[g] = true
+	}
+	for _, q := range []string{"練習", "isucon", "今日", "日は", "go で"} {
+		for _, g := range queryGrams(searchTerms(q)) {
+			if !indexed[g] {
+				t.Errorf("query %q: gram %q not indexed", q, g)
+			}
+		}
+	}
+}
+
+func TestQueryGramsIgnorePunctuation(t *testing.T) {
+	if grams := queryGrams(searchTerms("!!! ...")); len(grams) != 0 {
+		t.Fatalf("got grams %q for punctuation-only query", grams)
+	}
+	grams := queryGrams(searchTerms("a.bc"))
+	if strings.Join(grams, ",") != "bc" {
+		t.Fatalf("got %q, want [bc]", grams)
+	}
+}
+
+func TestSearchMemosPages(t *testing.T) {
+	app := newMemoryTestApp(t, nil)
+	for i := 1; i <= 12; i++ {
+		content := fmt.Sprintf("memo %d", i)
+		if i%3 == 0 {
+			content += " isucon"
+		}
+		if _, err := app.createMemo(httptest.NewRecorder(), 1, content, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page := func(offset, limit int) string {
+		results, more, _, err := app.searchMemos("isucon", nil, offset, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0)
+		for _, r := range results {
+			ids = append(ids, fmt.Sprint(r.Id))
+		}
+		return fmt.Sprintf("%s %v", strings.Join(ids, ","), more)
+	}
+	for _, tt := range []struct {
+		offset, limit int
+		want          string
+	}{
+		{0, 2, "12,9 true"},
+		{2, 2, "6,3 false"},
+		{0, 4, "12,9,6,3 false"},
+		{4, 2, " false"},
+	} {
+		if got := page(tt.offset, tt.limit); got != tt.want {
+			t.Errorf("searchMemos(isucon, %d, %d) = %s, want %s", tt.offset, tt.limit, got, tt.want)
+		}
+	}
+
+	if _, _, _, err := app.searchMemos("a 1", nil, 0, 10); err != errQueryTooShort {
+		t.Errorf("one-character query: err = %v", err)
+	}
+	if results, _, _, err := app.searchMemos("", nil, 0, 10); err != nil || len(results) != 0 {
+		t.Errorf("empty query = %v, %v", results, err)
+	}
+}
+
+func TestSearchMemosReportsCap(t *testing.T) {
+	app := newMemoryTestApp(t, nil)
+	memos := make([]*Memo, 0, searchMaxCandidates+1)
+	for i := 0; i <= searchMaxCandidates; i++ {
+		memo := &Memo{User: 1, Content: fmt.Sprintf("isucon %d", i)}
+		if err := app.Memos.CreateMemo(memo); err != nil {
+			t.Fatal(err)
+		}
+		memos = append(memos, memo)
+	}
+	if err := app.Index.Add(memos...); err != nil {
+		t.Fatal(err)
+	}
+	results, _, capped, err := app.searchMemos("isucon", nil, 0, 1)
+	if err != nil || !capped {
+		t.Fatalf("capped = %v, %v with %d matches", capped, err, len(memos))
+	}
+	if len(results) != 1 || results[0].Id != memos[len(memos)-1].Id {
+		t.Fatalf("got %v, want the newest memo", results)
+	}
+	if _, _, capped, _ := app.searchMemos("isucon 17", nil, 0, 1); capped {
+		t.Fatal("capped a query with few matches")
+	}
+}
+
+func TestContainsAll(t *testing.T) {
+	if !containsAll("Hello ISUCON world", searchTerms("isucon HELLO")) {
+		t.Fatal("expected case-insensitive match of all terms")
+	}
+	if containsAll("Hello world", searchTerms("hello isucon")) {
+		t.Fatal("matched a memo missing a term")
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	got := string(highlightSnippet("<b>ISUCON</b> 予選", searchTerms("isucon")))
+	want := "&lt;b&gt;<mark>ISUCON</mark>&lt;/b&gt; 予選"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	long := strings.Repeat("あ", 100) + "検索" + strings.Repeat("い", 100)
+	got = string(highlightSnippet(long, searchTerms("検索")))
+	if !strings.HasPrefix(got, "...") || !strings.HasSuffix(got, "...") {
+		t.Fatalf("snippet of long memo not elided: %q", got)
+	}
+	if !strings.Contains(got, "<mark>検索</mark>") {
+		t.Fatalf("match not highlighted: %q", got)
+	}
+}
@@ -259,6 +259,9 @@ type MemcacheStore struct {
 	Codecs   []securecookie.Codec
 	Options  *Options // default configuration
 	Memcache *memcache.Client
+	// Observe, if set, is called with "load" or "save" and how long the
+	// memcache round trip took.
+	Observe func(op string, d time.Duration)
 }
 
 // Get returns a session for the given name after adding it to the registry.
@@ -322,7 +325,11 @@ func (s *MemcacheStore) save(session *Session) error {
 		Value:      []byte(encoded),
 		Expiration: int32(session.Options.MaxAge)+int32(time.Now().Unix()),
 	}
+	start := time.Now()
 	err = s.Memcache.Set(item)
+	if s.Observe != nil {
+		s.Observe("save", time.Since(start))
+	}
 	if err != nil {
 		return err
 	}
@@ -332,7 +339,11 @@ func (s *MemcacheStore) save(session *Session) error {
 // load get from a memcache and decodes its content into session.Values.
 func (s *MemcacheStore) load(session *Session) error {
 	key := "session_" + session.ID
+	start := time.Now()
 	item, err := s.Memcache.Get(key)
+	if s.Observe != nil {
+		s.Observe("load", time.Since(start))
+	}
 	var value string
 	if item == nil {
 		return nil
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+)
+
+var usernameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// PasswordPolicy is the password_policy section of the config file.
+type PasswordPolicy struct {
+	MinLength     int  `json:"min_length"`
+	MaxLength     int  `json:"max_length"`
+	RequireLetter bool `json:"require_letter"`
+	RequireDigit  bool `json:"require_digit"`
+	RequireSymbol bool `json:"require_symbol"`
+}
+
+func (p PasswordPolicy) withDefaults() PasswordPolicy {
+	if p.MinLength <= 0 {
+		p.MinLength = 8
+	}
+	if p.MaxLength <= 0 {
+		p.MaxLength = 128
+	}
+	return p
+}
+
+// Validate returns a message for every rule password breaks.
+func (p PasswordPolicy) Validate(username, password string) []string {
+	errors := make([]string, 0)
+	n := utf8.RuneCountInString(password)
+	if n < p.MinLength {
+		errors = append(errors, fmt.Sprintf("password must be at least %d characters", p.MinLength))
+	}
+	if n > p.MaxLength {
+		errors = append(errors, fmt.Sprintf("password must be at most %d characters", p.MaxLength))
+	}
+	var letter, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			letter = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.RequireLetter && !letter {
+		errors = append(errors, "password must contain a letter")
+	}
+	if p.RequireDigit && !digit {
+		errors = append(errors, "password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		errors = append(errors, "password must contain a symbol")
+	}
+	if username != "" && strings.EqualFold(username, password) {
+		errors = append(errors, "password must differ from the username")
+	}
+	return errors
+}
+
+func validateUsername(username string) []string {
+	errors := make([]string, 0)
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		errors = append(errors, fmt.Sprintf("username must be %d to %d characters", minUsernameLength, maxUsernameLength))
+	}
+	if !usernameRegexp.MatchString(username) {
+		errors = append(errors, "username may only contain letters, digits, '_' and '-'")
+	}
+	return errors
+}
+
+func (app *App) signupHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if session.Values["user_id"] != nil {
+		http.Redirect(w, r, "/mypage", http.StatusFound)
+		return
+	}
+	if session.Values["token"] == nil {
+		// for antiCSRF, so no other site can sign a browser up
+		session.Values["token"] = fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+		if err := session.Save(r, w); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	v := &View{
+		Session: session,
+	}
+	if err := app.render(w, r, "signup", v); err != nil {
+		serverError(w, err)
+	}
+}
+
+func (app *App) signupPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	if antiCSRF(w, r, session) {
+		return
+	}
+	if wait, err := app.LoginThrottle.signup(app.throttle, app.clientIP(r)); err != nil {
+		serverError(w, err)
+		return
+	} else if wait > 0 {
+		w.WriteHeader(http.StatusTooManyRequests)
+		v := &View{
+			Errors:  []string{signupThrottleMessage(wait)},
+			Form:    map[string]string{"username": r.FormValue("username")},
+			Session: session,
+		}
+		if err := app.render(w, r, "signup", v); err != nil {
+			serverError(w, err)
+		}
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+	errors := validateUsername(username)
+	errors = append(errors, app.PasswordPolicy.Validate(username, password)...)
+	if max := app.Hasher.MaxPasswordBytes(); max > 0 && len(password) > max {
+		errors = append(errors, fmt.Sprintf("password must be at most %d bytes (letters outside ASCII take 2 to 4)", max))
+	}
+	if password != r.FormValue("password_confirm") {
+		errors = append(errors, "passwords do not match")
+	}
+
+	var userId int
+	if len(errors) == 0 {
+		encoded, err := app.Hasher.Hash(password)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		userId, err = app.Users.CreateUser(username, encoded)
+		if err == errUsernameTaken {
+			errors = append(errors, err.Error())
+		} else if err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+	if len(errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		v := &View{
+			Errors:  errors,
+			Form:    map[string]string{"username": username},
+			Session: session,
+		}
+		if err := app.render(w, r, "signup", v); err != nil {
+			serverError(w, err)
+		}
+		return
+	}
+
+	app.setUserName(userId, username)
+	if err := startSession(r, w, session, userId); err != nil {
+		serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/mypage", http.StatusFound)
+}
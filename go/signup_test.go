@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := PasswordPolicy{RequireLetter: true, RequireDigit: true}.withDefaults()
+	tests := []struct {
+		username, password string
+		errors             int
+	}{
+		{"alice", "correct9horse", 0},
+		{"alice", "short1", 1},
+		{"alice", "nodigitshere", 1},
+		{"alice", "12345678", 1},
+		{"alice1234", "ALICE1234", 1},
+	}
+	for _, tt := range tests {
+		if got := policy.Validate(tt.username, tt.password); len(got) != tt.errors {
+			t.Errorf("Validate(%q, %q) = %q, want %d errors", tt.username, tt.password, got, tt.errors)
+		}
+	}
+
+	strict := PasswordPolicy{MinLength: 4, RequireSymbol: true}.withDefaults()
+	if got := strict.Validate("bob", "abcd"); len(got) != 1 {
+		t.Errorf("symbol rule: got %q", got)
+	}
+	if got := strict.Validate("bob", "ab!d"); len(got) != 0 {
+		t.Errorf("symbol rule: got %q", got)
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for _, ok := range []string{"abc", "user_01", "a-b-c"} {
+		if errs := validateUsername(ok); len(errs) != 0 {
+			t.Errorf("validateUsername(%q) = %q", ok, errs)
+		}
+	}
+	for _, bad := range []string{"ab", "has space", "ユーザー", "a/b", "abcdefghijklmnopqrstuvwxyz0123456"} {
+		if errs := validateUsername(bad); len(errs) == 0 {
+			t.Errorf("validateUsername(%q) accepted", bad)
+		}
+	}
+}
+
+func TestSetUserNameGrows(t *testing.T) {
+	app := newTestApp(t, nil)
+	app.setUserName(1234, "late")
+	if got := app.getUserName(1234); got != "late" {
+		t.Fatalf("getUserName(1234) = %q", got)
+	}
+	if got := app.getUserName(999999); got != "" {
+		t.Fatalf("getUserName out of range = %q", got)
+	}
+}
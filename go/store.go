@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Handlers reach their data through three interfaces. The "mysql" storage
+// keeps users and memos in MySQL (mysql.go) and the lists, tag sets and
+// search index in Redis (redis.go); the "memory" storage keeps everything
+// in process (memory.go), so the app runs with no external services.
+
+var errUsernameTaken = errors.New("username is already taken")
+
+type UserRepository interface {
+	// User and UserByName return nil when there is no such user.
+	User(id int) (*User, error)
+	UserByName(username string) (*User, error)
+	// Users returns every user in id order.
+	Users() ([]*User, error)
+	// CreateUser returns errUsernameTaken when username is in use.
+	CreateUser(username, encodedPassword string) (int, error)
+	SetPassword(id int, encodedPassword string) error
+	// TouchUser sets last_access to now.
+	TouchUser(id int) error
+
+	CreateToken(userId int, name, tokenHash, scope string) error
+	// TokenUser returns the token with tokenHash and its owner, or nils.
+	TokenUser(tokenHash string) (*APIToken, *User, error)
+	// TouchToken sets last_used_at to now.
+	TouchToken(id int) error
+	Tokens(userId int) ([]*APIToken, error)
+	// RevokeToken reports whether userId had a token with that id.
+	RevokeToken(id, userId int) (bool, error)
+}
+
+// MemoRepository stores memos and their tags. Memos in the trash are only
+// returned by the Trashed methods.
+type MemoRepository interface {
+	// Memo returns the memo with its Tags, or nil.
+	Memo(id int) (*Memo, error)
+	// Memos returns the memos with the given ids in that order, without
+	// Tags, skipping ids that do not exist.
+	Memos(ids []int) (Memos, error)
+	// PublicMemosOf returns userId's public memos, oldest first.
+	PublicMemosOf(userId int) (Memos, error)
+	// CreateMemo stores memo and sets its Id.
+	CreateMemo(memo *Memo) error
+	// UpdateMemo saves the Content, IsPrivate and Tags of memo.
+	UpdateMemo(memo *Memo) error
+	// Scan calls fn with every memo, Tags included, in id order and in
+	// batches of up to batchSize.
+	Scan(batchSize int, fn func(Memos) error) error
+
+	// TrashMemo moves a memo to the trash, leaving updated_at alone.
+	TrashMemo(id int) error
+	// TrashedMemo returns userId's memo from the trash with its Tags, or nil.
+	TrashedMemo(id, userId int) (*Memo, error)
+	// TrashedMemos returns userId's trash, most recently deleted first.
+	TrashedMemos(userId int) (Memos, error)
+	RestoreMemo(id int) error
+	// PurgeMemo deletes userId's memo from the trash for good and
+	// reports whether there was one.
+	PurgeMemo(id, userId int) (bool, error)
+	// PurgeTrash deletes memos trashed longer than retention ago and
+	// returns how many.
+	PurgeTrash(retention time.Duration) (int64, error)
+}
+
+// MemoIndex holds the listings that would be slow to query: memo id lists,
+// tag sets and tag clouds, and the n-gram search index. Lists of public
+// memos are newest first, lists that include private memos oldest first.
+type MemoIndex interface {
+	PublicMemos(offset, limit int) ([]int, error)
+	PublicMemoCount() (int, error)
+	UserPublicMemos(userId, offset, limit int) ([]int, error)
+	UserMemos(userId int) ([]int, error)
+	// PublicUpdated returns when a public memo was last added, changed,
+	// made private or removed, and UserPublicUpdated the same for one
+	// user's; the zero time if none has been since Reset.
+	PublicUpdated() (time.Time, error)
+	UserPublicUpdated(userId int) (time.Time, error)
+	// TagMemos returns a page of the public memos tagged tag and how
+	// many there are in all.
+	TagMemos(tag string, offset, limit int) ([]int, int, error)
+	UserTagMemos(userId int, tag string) ([]int, error)
+	TagCloud() ([]*TagCount, error)
+	UserTagCloud(userId int) ([]*TagCount, error)
+	// Search returns the ids of the memos having every gram.
+	Search(grams []string) ([]int, error)
+
+	// Add indexes memos newer than any memo already indexed, in id order.
+	Add(memos ...*Memo) error
+	// Restore indexes a memo of any age, in its place.
+	Restore(memo *Memo) error
+	// Update reindexes old as memo after a change of content, visibility
+	// or tags.
+	Update(old, memo *Memo) error
+	Remove(memo *Memo) error
+
+	// Reset empties the index, and MarkMigrated records that it has been
+	// rebuilt since; Migrated reports that.
+	Reset() error
+	MarkMigrated() error
+	Migrated() (bool, error)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+)
+
+// Tags live in the memo_tags table and, with the mysql storage, are
+// indexed in Redis sorted sets scored by memo id, as the memo lists of
+// redis.go are:
+//
+//	tag_public_memos:{tag}        public memos with the tag
+//	tag_cloud                     tag -> number of public memos
+//	user_tag_memos:{uid}:{tag}    all of a user's memos with the tag
+//	user_tag_cloud:{uid}          tag -> number of the user's memos
+//
+// Private memos only ever touch the user_ keys, which are shown to their
+// owner alone.
+//
+// memo_tags.tag is varchar(maxTagLength) in MySQL's 3-byte utf8, so a tag
+// is at most that many characters, all in the Basic Multilingual Plane.
+
+const (
+	maxTagLength = 64
+	tagCloudSize = 50
+)
+
+var (
+	hashTagRegexp = regexp.MustCompile(`(?:^|[\s(])#([\p{L}\p{N}_-]+)`)
+	tagRegexp     = regexp.MustCompile(`^[\p{L}\p{N}_-]+$`)
+)
+
+type TagCount struct {
+	Name  string
+	Count int
+}
+
+func normalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+	if utf8.RuneCountInString(tag) > maxTagLength || !tagRegexp.MatchString(tag) {
+		return ""
+	}
+	for _, c := range tag {
+		if c > 0xFFFF {
+			return ""
+		}
+	}
+	return tag
+}
+
+// memoTags returns the #tags in content plus the comma or space separated
+// tags typed into the form field, normalised and de-duplicated.
+func memoTags(content, field string) []string {
+	seen := make(map[string]bool)
+	tags := make([]string, 0)
+	add := func(t string) {
+		if t = normalizeTag(t); t != "" && !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	for _, m := range hashTagRegexp.FindAllStringSubmatch(content, -1) {
+		add(m[1])
+	}
+	for _, t := range strings.FieldsFunc(field, func(c rune) bool { return c == ',' || c == ' ' || c == '\t' }) {
+		add(t)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// indexMemoTags queues the Redis commands adding memo to its tag indexes;
+// callers wrap it in MULTI/EXEC.
+func indexMemoTags(rdb redis.Conn, memoId, userId, isPrivate int, tags []string) {
+	for _, tag := range tags {
+		rdb.Send("ZADD", fmt.Sprintf("user_tag_memos:%d:%s", userId, tag), memoId, memoId)
+		rdb.Send("ZINCRBY", fmt.Sprintf("user_tag_cloud:%d", userId), 1, tag)
+		if isPrivate == 0 {
+			rdb.Send("ZADD", "tag_public_memos:"+tag, memoId, memoId)
+			rdb.Send("ZINCRBY", "tag_cloud", 1, tag)
+		}
+	}
+}
+
+func unindexMemoTags(rdb redis.Conn, memoId, userId, isPrivate int, tags []string) {
+	userCloud := fmt.Sprintf("user_tag_cloud:%d", userId)
+	for _, tag := range tags {
+		rdb.Send("ZREM", fmt.Sprintf("user_tag_memos:%d:%s", userId, tag), memoId)
+		rdb.Send("ZINCRBY", userCloud, -1, tag)
+		if isPrivate == 0 {
+			rdb.Send("ZREM", "tag_public_memos:"+tag, memoId)
+			rdb.Send("ZINCRBY", "tag_cloud", -1, tag)
+		}
+	}
+	if len(tags) > 0 {
+		rdb.Send("ZREMRANGEBYSCORE", userCloud, "-inf", 0)
+		if isPrivate == 0 {
+			rdb.Send("ZREMRANGEBYSCORE", "tag_cloud", "-inf", 0)
+		}
+	}
+}
+
+func tagCloud(rdb redis.Conn, key string) ([]*TagCount, error) {
+	values, err := redis.Values(rdb.Do("ZREVRANGE", key, 0, tagCloudSize-1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	cloud := make([]*TagCount, 0, len(values)/2)
+	for len(values) > 0 {
+		var tc TagCount
+		if values, err = redis.Scan(values, &tc.Name, &tc.Count); err != nil {
+			return nil, err
+		}
+		cloud = append(cloud, &tc)
+	}
+	sort.Sort(tagsByName(cloud))
+	return cloud, nil
+}
+
+type tagsByName []*TagCount
+
+func (t tagsByName) Len() int           { return len(t) }
+func (t tagsByName) Less(i, j int) bool { return t[i].Name < t[j].Name }
+func (t tagsByName) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+func (app *App) tagHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	vars := mux.Vars(r)
+	tag := normalizeTag(vars["tag"])
+	page, _ := strconv.Atoi(vars["page"])
+	if tag == "" {
+		notFound(w)
+		return
+	}
+	user := app.getUser(w, r, session)
+
+	memoIds, totalCount, err := app.Index.TagMemos(tag, app.MemosPerPage*page, app.MemosPerPage)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	memos, err := app.lookupMemoMulti(memoIds)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if len(memos) == 0 {
+		notFound(w)
+		return
+	}
+
+	v := &View{
+		Total:     totalCount,
+		Page:      page,
+		PageStart: app.MemosPerPage*page + 1,
+		PageEnd:   app.MemosPerPage * (page + 1),
+		Memos:     &memos,
+		Tag:       tag,
+		User:      user,
+		Session:   session,
+	}
+	if err = app.render(w, r, "index", v); err != nil {
+		serverError(w, err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMemoTags(t *testing.T) {
+	tests := []struct {
+		content, field string
+		want           []string
+	}{
+		{"#Go and #isucon\nmore #go", "", []string{"go", "isucon"}},
+		{"# heading\nissue#12 and (#日本語)", "", []string{"日本語"}},
+		{"no tags", "perf, Redis  mysql", []string{"mysql", "perf", "redis"}},
+		{"#bad!tag", "#ok not/ok", []string{"bad", "ok"}},
+		{"#𝒜lpha #ok", "", []string{"ok"}},
+		{"", strings.Repeat("あ", maxTagLength) + " " + strings.Repeat("い", maxTagLength+1), []string{strings.Repeat("あ", maxTagLength)}},
+	}
+	for _, tt := range tests {
+		got := memoTags(tt.content, tt.field)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("memoTags(%q, %q) = %q, want %q", tt.content, tt.field, got, tt.want)
+		}
+	}
+}
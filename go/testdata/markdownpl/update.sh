@@ -0,0 +1,6 @@
+#!/bin/sh
+# Regenerates the expected HTML for each .md here from bin/markdown.
+cd "$(dirname "$0")" || exit 1
+for md in *.md; do
+	perl ../../../bin/markdown "$md" > "${md%.md}.html" || exit 1
+done
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Failed sign-ins are counted per username and per client IP, and
+// sign-ups per client IP:
+//
+//	login_failures:{kind}:{id}    failures within the window (INCR)
+//	login_wait:{kind}:{id}        present while further attempts are refused
+//	signups:ip:{ip}               sign-ups within the window (INCR)
+//
+// Each failure past the free attempts doubles the wait, and reaching the
+// maximum locks the username or IP out for LockoutSeconds. A successful
+// sign-in clears the username's counters but not the IP's, so an attacker
+// cannot reset their own budget by signing into an account of their own.
+
+// LoginThrottle is the login_throttle section of the config file.
+type LoginThrottle struct {
+	FreeAttempts       int `json:"free_attempts"`
+	MaxFailures        int `json:"max_failures"`
+	IPFreeAttempts     int `json:"ip_free_attempts"`
+	IPMaxFailures      int `json:"ip_max_failures"`
+	BackoffBaseSeconds int `json:"backoff_base_seconds"`
+	LockoutSeconds     int `json:"lockout_seconds"`
+	WindowSeconds      int `json:"window_seconds"`
+	// SignupsPerIP is how many sign-ups one client IP may make within
+	// the window.
+	SignupsPerIP int `json:"signups_per_ip"`
+}
+
+func (t LoginThrottle) withDefaults() LoginThrottle {
+	if t.FreeAttempts <= 0 {
+		t.FreeAttempts = 3
+	}
+	if t.MaxFailures <= 0 {
+		t.MaxFailures = 10
+	}
+	if t.IPFreeAttempts <= 0 {
+		t.IPFreeAttempts = 20
+	}
+	if t.IPMaxFailures <= 0 {
+		t.IPMaxFailures = 100
+	}
+	if t.BackoffBaseSeconds <= 0 {
+		t.BackoffBaseSeconds = 1
+	}
+	if t.LockoutSeconds <= 0 {
+		t.LockoutSeconds = 15 * 60
+	}
+	if t.WindowSeconds <= 0 {
+		t.WindowSeconds = 60 * 60
+	}
+	if t.SignupsPerIP <= 0 {
+		t.SignupsPerIP = 20
+	}
+	return t
+}
+
+// delay is how long to refuse attempts after the n-th consecutive failure.
+func (t LoginThrottle) delay(n, free, max int) time.Duration {
+	lockout := time.Duration(t.LockoutSeconds) * time.Second
+	if n >= max {
+		return lockout
+	}
+	if n <= free {
+		return 0
+	}
+	d := time.Duration(t.BackoffBaseSeconds) * time.Second
+	for i := free + 1; i < n && d < lockout; i++ {
+		d *= 2
+	}
+	if d > lockout {
+		d = lockout
+	}
+	return d
+}
+
+type throttleKey struct {
+	kind, id  string
+	free, max int
+}
+
+// keys returns the counters an attempt counts against. A client whose
+// address is unknown has no ip counter; one shared by all such clients
+// would let any of them lock out the rest.
+func (t LoginThrottle) keys(username, ip string) []throttleKey {
+	keys := []throttleKey{
+		{"user", strings.ToLower(username), t.FreeAttempts, t.MaxFailures},
+	}
+	if ip != unknownClientIP {
+		keys = append(keys, throttleKey{"ip", ip, t.IPFreeAttempts, t.IPMaxFailures})
+	}
+	return keys
+}
+
+// throttleStore keeps the counters above. redisThrottleStore keeps them
+// in Redis and memThrottleStore in process memory.
+type throttleStore interface {
+	// ttl is how long key has left to live; zero when it does not exist.
+	ttl(key string) (time.Duration, error)
+	// incr increments key, which expires window after the last increment.
+	incr(key string, window time.Duration) (int, error)
+	// set stores n at key for d.
+	set(key string, n int, d time.Duration) error
+	del(keys ...string) error
+}
+
+// wait returns how long the caller must wait before trying to sign in as
+// username from ip again; zero means go ahead.
+func (t LoginThrottle) wait(store throttleStore, username, ip string) (time.Duration, error) {
+	var longest time.Duration
+	for _, k := range t.keys(username, ip) {
+		d, err := store.ttl(fmt.Sprintf("login_wait:%s:%s", k.kind, k.id))
+		if err != nil {
+			return 0, err
+		}
+		if d > longest {
+			longest = d
+		}
+	}
+	return longest, nil
+}
+
+// fail records a failed sign-in and returns the resulting wait.
+func (t LoginThrottle) fail(store throttleStore, username, ip string) (time.Duration, error) {
+	var longest time.Duration
+	window := time.Duration(t.WindowSeconds) * time.Second
+	for _, k := range t.keys(username, ip) {
+		n, err := store.incr(fmt.Sprintf("login_failures:%s:%s", k.kind, k.id), window)
+		if err != nil {
+			return 0, err
+		}
+		d := t.delay(n, k.free, k.max)
+		if d == 0 {
+			continue
+		}
+		if n == k.max {
+			log.Printf("login: %s %q locked out after %d failures", k.kind, k.id, n)
+		}
+		if err := store.set(fmt.Sprintf("login_wait:%s:%s", k.kind, k.id), n, d); err != nil {
+			return 0, err
+		}
+		if d > longest {
+			longest = d
+		}
+	}
+	return longest, nil
+}
+
+func (t LoginThrottle) reset(store throttleStore, username string) error {
+	id := strings.ToLower(username)
+	return store.del("login_failures:user:"+id, "login_wait:user:"+id)
+}
+
+// signup counts a sign-up attempt from ip and returns how long ip must
+// wait once it has made more than SignupsPerIP within the window. Clients
+// of unknown address are not counted, as in keys.
+func (t LoginThrottle) signup(store throttleStore, ip string) (time.Duration, error) {
+	if ip == unknownClientIP {
+		return 0, nil
+	}
+	key := "signups:ip:" + ip
+	n, err := store.incr(key, time.Duration(t.WindowSeconds)*time.Second)
+	if err != nil || n <= t.SignupsPerIP {
+		return 0, err
+	}
+	return store.ttl(key)
+}
+
+type redisThrottleStore struct {
+	pool *redis.Pool
+	wait time.Duration
+}
+
+func (s *redisThrottleStore) ttl(key string) (time.Duration, error) {
+	c, err := redisConn(s.pool, s.wait)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	ms, err := redis.Int64(c.Do("PTTL", key))
+	if err != nil || ms < 0 {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (s *redisThrottleStore) incr(key string, window time.Duration) (int, error) {
+	c, err := redisConn(s.pool, s.wait)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	n, err := redis.Int(c.Do("INCR", key))
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.Do("EXPIRE", key, int64(window/time.Second))
+	return n, err
+}
+
+func (s *redisThrottleStore) set(key string, n int, d time.Duration) error {
+	c, err := redisConn(s.pool, s.wait)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Do("SET", key, n, "PX", int64(d/time.Millisecond))
+	return err
+}
+
+func (s *redisThrottleStore) del(keys ...string) error {
+	c, err := redisConn(s.pool, s.wait)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	args := make([]interface{}, len(keys))
+	for i, k := range keys {
+		args[i] = k
+	}
+	_, err = c.Do("DEL", args...)
+	return err
+}
+
+func throttleMessage(d time.Duration) string {
+	return "Too many failed sign-in attempts. " + tryAgainIn(d)
+}
+
+func signupThrottleMessage(d time.Duration) string {
+	return "Too many sign-ups from your address. " + tryAgainIn(d)
+}
+
+func tryAgainIn(d time.Duration) string {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs >= 120 {
+		return fmt.Sprintf("Try again in %d minutes.", (secs+59)/60)
+	}
+	return fmt.Sprintf("Try again in %d seconds.", secs)
+}
+
+// Trusted proxies ------------------------------------------------------------
+
+// defaultTrustedProxies is used when trusted_proxies is not configured.
+var defaultTrustedProxies = []string{"127.0.0.1/32", "::1/128"}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %s", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (app *App) isTrustedProxy(ip net.IP) bool {
+	for _, n := range app.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP is the address of the peer, or nil when it is not an IP, as
+// for connections on the unix socket nginx talks to.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// fromTrustedProxy reports whether r came straight from a trusted proxy
+// whose X-Forwarded-* headers may be believed.
+func (app *App) fromTrustedProxy(r *http.Request) bool {
+	ip := remoteIP(r)
+	return ip == nil || app.isTrustedProxy(ip)
+}
+
+// clientIP returns the address of the client, following X-Forwarded-For
+// from right to left for as long as the hops are trusted proxies.
+func (app *App) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if app.fromTrustedProxy(r) {
+		hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !app.isTrustedProxy(hop) {
+				break
+			}
+		}
+	}
+	if ip == nil {
+		return unknownClientIP
+	}
+	return ip.String()
+}
+
+// unknownClientIP is what clientIP returns for a client with no IP, such
+// as one on a unix socket with no X-Forwarded-For.
+const unknownClientIP = "unknown"
+
+// fromLoopback reports whether the client, as seen through any trusted
+// proxies, is on this machine.
+func (app *App) fromLoopback(r *http.Request) bool {
+	ip := net.ParseIP(app.clientIP(r))
+	return ip != nil && ip.IsLoopback()
+}
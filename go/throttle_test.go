@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleDelay(t *testing.T) {
+	th := LoginThrottle{FreeAttempts: 2, MaxFailures: 8, BackoffBaseSeconds: 1, LockoutSeconds: 60}.withDefaults()
+	want := []time.Duration{0, 0, 0, 1, 2, 4, 8, 16, 60, 60}
+	for n, w := range want {
+		if got := th.delay(n, th.FreeAttempts, th.MaxFailures); got != w*time.Second {
+			t.Errorf("delay(%d) = %s, want %s", n, got, w*time.Second)
+		}
+	}
+
+	capped := LoginThrottle{FreeAttempts: 1, MaxFailures: 100, LockoutSeconds: 10}.withDefaults()
+	if got := capped.delay(50, 1, 100); got != 10*time.Second {
+		t.Errorf("delay is not capped at the lockout: %s", got)
+	}
+}
+
+func TestLoginThrottleSkipsUnknownIP(t *testing.T) {
+	th := LoginThrottle{}.withDefaults()
+	store := newMemThrottleStore()
+	for i := 0; i < th.IPMaxFailures+1; i++ {
+		if _, err := th.fail(store, fmt.Sprintf("user%d", i), unknownClientIP); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait, err := th.wait(store, "someone-else", unknownClientIP); err != nil || wait != 0 {
+		t.Errorf("clients with unknown addresses share a bucket: wait = %s, %v", wait, err)
+	}
+	for _, k := range th.keys("alice", unknownClientIP) {
+		if k.kind == "ip" {
+			t.Errorf("keys has an ip counter for an unknown address: %+v", k)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remote, xff, want string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		{"127.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"127.0.0.1:1234", "1.2.3.4, 198.51.100.1, 127.0.0.1", "198.51.100.1"},
+		{"127.0.0.1:1234", "garbage, 198.51.100.1", "198.51.100.1"},
+		{"127.0.0.1:1234", "", "127.0.0.1"},
+		{"@", "198.51.100.1", "198.51.100.1"},
+		{"@", "", unknownClientIP},
+	}
+	app := newTestApp(t, nil)
+	for _, tt := range tests {
+		r, _ := http.NewRequest("POST", "/signin", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := app.clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%q, %q) = %s, want %s", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 || nets[1].String() != "192.0.2.1/32" || nets[2].String() != "::1/128" {
+		t.Fatalf("parseCIDRs = %v", nets)
+	}
+	if _, err := parseCIDRs([]string{"not-an-ip"}); err == nil {
+		t.Fatal("parseCIDRs accepted garbage")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+)
+
+// Personal access tokens let scripts authenticate with
+// "Authorization: Bearer <token>" instead of the session cookie. Only the
+// sha256 of a token is stored; the token itself is shown once, in the
+// response to the POST that made it, and never kept in the session.
+
+const (
+	tokenScopeRead  = "read"
+	tokenScopeWrite = "write"
+)
+
+type APIToken struct {
+	Id         int
+	User       int
+	Name       string
+	Scope      string
+	CreatedAt  string
+	LastUsedAt sql.NullString
+}
+
+// bearerToken returns the token from the Authorization header, if any.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+func hashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// getTokenUser resolves a bearer token to its user. A read-only token
+// authenticates nobody on requests that are not GET or HEAD.
+func (app *App) getTokenUser(r *http.Request, token string) (*User, error) {
+	t, user, err := app.Users.TokenUser(hashToken(token))
+	if err != nil || t == nil {
+		return nil, err
+	}
+	if t.Scope != tokenScopeWrite && r.Method != "GET" && r.Method != "HEAD" {
+		return nil, nil
+	}
+	if err := app.Users.TouchToken(t.Id); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (app *App) tokenPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	// tokens are managed from the browser only, never with another token
+	if bearerToken(r) != "" {
+		forbidden(w)
+		return
+	}
+	if antiCSRF(w, r, session) {
+		return
+	}
+
+	user := app.getUser(w, r, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	scope := tokenScopeRead
+	if r.FormValue("scope") == tokenScopeWrite {
+		scope = tokenScopeWrite
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = "token"
+	}
+	token := fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+	if err := app.Users.CreateToken(user.Id, name, hashToken(token), scope); err != nil {
+		serverError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	app.renderMypage(w, r, session, user, token)
+}
+
+func (app *App) tokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if bearerToken(r) != "" {
+		forbidden(w)
+		return
+	}
+	if antiCSRF(w, r, session) {
+		return
+	}
+	vars := mux.Vars(r)
+	tokenId, _ := strconv.Atoi(vars["token_id"])
+
+	user := app.getUser(w, r, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	revoked, err := app.Users.RevokeToken(tokenId, user.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if !revoked {
+		notFound(w)
+		return
+	}
+	http.Redirect(w, r, "/mypage", http.StatusFound)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultTrashRetentionDays = 30
+	trashPurgeInterval        = time.Hour
+)
+
+func trashRetention(config *Config) time.Duration {
+	days := config.Trash.RetentionDays
+	if days <= 0 {
+		days = defaultTrashRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// purgeTrashLoop permanently removes memos that have been in the trash
+// for longer than retention. Each failed pass is logged under a fresh ID,
+// like a request's.
+func (app *App) purgeTrashLoop(retention time.Duration) {
+	for {
+		if err := app.purgeTrash(retention); err != nil {
+			logErrorID(newRequestID(), fmt.Errorf("purge trash: %s", err))
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+func (app *App) purgeTrash(retention time.Duration) error {
+	n, err := app.Memos.PurgeTrash(retention)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("purged %d memos from trash", n)
+	}
+	return nil
+}
+
+func (app *App) memoDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if antiCSRF(w, r, session) {
+		return
+	}
+	vars := mux.Vars(r)
+	memoId, _ := strconv.Atoi(vars["memo_id"])
+
+	user := app.getUser(w, r, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	memo, err := app.Memos.Memo(memoId)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if memo == nil || memo.User != user.Id {
+		notFound(w)
+		return
+	}
+	if err = app.Memos.TrashMemo(memo.Id); err != nil {
+		serverError(w, err)
+		return
+	}
+	if err = app.Index.Remove(memo); err != nil {
+		// the memo is trashed; only listings lag until the next /init
+		logError(w, fmt.Errorf("memo %d: %s", memo.Id, err))
+	}
+	if memo.IsPrivate == 0 {
+		app.cache.Decrement("public_memo_count", 1)
+	}
+	http.Redirect(w, r, "/mypage", http.StatusFound)
+}
+
+func (app *App) trashHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	user := app.getUser(w, r, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	memos, err := app.Memos.TrashedMemos(user.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	for _, m := range memos {
+		m.Username = user.Username
+	}
+
+	v := &View{
+		Memos:   &memos,
+		User:    user,
+		Session: session,
+	}
+	if err = app.render(w, r, "trash", v); err != nil {
+		serverError(w, err)
+	}
+}
+
+func (app *App) trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if antiCSRF(w, r, session) {
+		return
+	}
+	vars := mux.Vars(r)
+	memoId, _ := strconv.Atoi(vars["memo_id"])
+
+	user := app.getUser(w, r, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	memo, err := app.Memos.TrashedMemo(memoId, user.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if memo == nil {
+		notFound(w)
+		return
+	}
+	if err = app.Memos.RestoreMemo(memo.Id); err != nil {
+		serverError(w, err)
+		return
+	}
+	if err = app.Index.Restore(memo); err != nil {
+		logError(w, fmt.Errorf("memo %d: %s", memo.Id, err))
+	}
+	if memo.IsPrivate == 0 {
+		app.cache.Increment("public_memo_count", 1)
+	}
+	app.cacheHTML(requestID(w), memo.Content)
+	http.Redirect(w, r, fmt.Sprintf("/memo/%d", memo.Id), http.StatusFound)
+}
+
+func (app *App) trashPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := app.loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if antiCSRF(w, r, session) {
+		return
+	}
+	vars := mux.Vars(r)
+	memoId, _ := strconv.Atoi(vars["memo_id"])
+
+	user := app.getUser(w, r, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	purged, err := app.Memos.PurgeMemo(memoId, user.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if !purged {
+		notFound(w)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusFound)
+}